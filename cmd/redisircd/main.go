@@ -15,6 +15,17 @@ var (
 	flagName   = flag.String("name", func() string { h, _ := os.Hostname(); return h }(), "Hostname of the server")
 	flagRedis  = flag.String("redis", "localhost:6379", "host:port to connect to Redis at")
 	flagDebug  = flag.Bool("debug", false, "Enable debugging")
+
+	flagAccounts = flag.String("accounts", "redisircd:accounts", "Redis hash of account names to bcrypt password hashes, for SASL")
+	flagHistory  = flag.String("history", "redisircd:history:", "Prefix of Redis streams to keep channel history in, empty to disable")
+	flagHistLen  = flag.Int("history-length", 1000, "Approximate number of messages of history to keep per channel")
+	flagMOTD     = flag.String("motd", "", "File to read the MOTD from")
+	flagMOTDKey  = flag.String("motd-key", "", "Redis key to read the MOTD from, instead of a file")
+	flagAdmin    = flag.String("admin", "", "Contact details for the server administrator")
+	flagOpers    = flag.String("opers", "", "File of operator names and bcrypt password hashes, for OPER")
+	flagAway     = flag.String("away", "redisircd:away", "Prefix of the Redis hash to keep away messages in by nick, the server name is appended, empty to disable")
+	flagTemplate = flag.String("templates", "", "File of Go text/templates for JSON payloads, used by name with +F")
+	flagUTF8Only = flag.Bool("utf8only", false, "Reject messages from clients that aren't UTF-8, advertised as UTF8ONLY")
 )
 
 func main() {
@@ -23,6 +34,19 @@ func main() {
 
 	http.Start(*flagRedis)
 	srv := irc.NewServer(*flagName, *flagRedis, *flagDebug)
+	srv.AccountsKey = *flagAccounts
+	srv.HistoryKey = *flagHistory
+	srv.HistoryLength = *flagHistLen
+	srv.AwayKey = *flagAway
+	srv.MOTDFile = *flagMOTD
+	srv.MOTDKey = *flagMOTDKey
+	srv.Admin = *flagAdmin
+	srv.OperFile = *flagOpers
+	srv.UTF8Only = *flagUTF8Only
+	srv.TemplateFile = *flagTemplate
+	if err := srv.Rehash(); err != nil {
+		log.Fatal(err)
+	}
 
 	if *flagVersion {
 		os.Exit(0)
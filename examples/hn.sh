@@ -4,6 +4,9 @@
 
 # ./hn.sh => top stories
 # ./hn.sh new => new stories
+#
+# The topic is set in the "hn:topic" key, use "/mode #hn +K hn:topic" to show
+# it on the channel.
 
 set -euo pipefail
 
@@ -27,6 +30,7 @@ seen() {
 }
 
 echo "Watching for $type stories and publishing to $pub"
+redis-cli set "${pub}:topic" "Hacker News $type stories" >/dev/null
 
 while :; do
   for id in $(stories $type); do
@@ -26,6 +26,10 @@ stdbuf -oL redis-cli subscribe "${pubsub}:out" | while read type; do
   if [[ $type != message ]]; then
     continue
   fi
+  if [[ ${message:0:2} = "* " ]]; then
+    # An action (/me), "* nick text", not something to answer
+    continue
+  fi
   nick="${message/ */}"
   text="${message/+([^ ]) /}"
 
@@ -6,5 +6,6 @@ require (
 	github.com/PaesslerAG/jsonpath v0.1.1
 	github.com/mediocregopher/radix/v4 v4.0.0-beta.1
 	github.com/prometheus/client_golang v1.11.0
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
 	gopkg.in/sorcix/irc.v2 v2.0.0-20200812151606-3f15758ea8c7
 )
@@ -0,0 +1,177 @@
+package irc
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/dgl/redisircd/ircbuf"
+
+	"gopkg.in/sorcix/irc.v2"
+)
+
+// capability is an IRCv3 capability the server supports, Value is only sent
+// to clients using CAP LS 302.
+type capability struct {
+	Name, Value string
+}
+
+var capabilities = []capability{
+	{Name: "account-notify"},
+	{Name: "away-notify"},
+	{Name: "batch"},
+	{Name: "cap-notify"},
+	{Name: "echo-message"},
+	{Name: "labeled-response"},
+	{Name: "message-tags"},
+	{Name: "multi-prefix"},
+	{Name: "sasl", Value: "PLAIN"},
+	{Name: "server-time"},
+	{Name: "draft/chathistory"},
+	{Name: "userhost-in-names"},
+}
+
+func supportedCap(name string) bool {
+	for _, c := range capabilities {
+		if c.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// capSet is the set of capabilities a client has enabled. It is written by the
+// client, but read by the channel and nick servers.
+type capSet struct {
+	sync.RWMutex
+	enabled map[string]bool
+}
+
+func (cs *capSet) has(name string) bool {
+	cs.RLock()
+	defer cs.RUnlock()
+	return cs.enabled[name]
+}
+
+func (cs *capSet) set(name string, on bool) {
+	cs.Lock()
+	defer cs.Unlock()
+	if cs.enabled == nil {
+		cs.enabled = make(map[string]bool)
+	}
+	if on {
+		cs.enabled[name] = true
+	} else {
+		delete(cs.enabled, name)
+	}
+}
+
+func (cs *capSet) list() []string {
+	cs.RLock()
+	defer cs.RUnlock()
+	var l []string
+	for _, c := range capabilities {
+		if cs.enabled[c.Name] {
+			l = append(l, c.Name)
+		}
+	}
+	return l
+}
+
+func (c *Client) cap(m *ircbuf.Message) error {
+	if len(m.Params) < 1 {
+		c.reply(irc.ERR_NEEDMOREPARAMS, "CAP", "Not enough parameters")
+		return nil
+	}
+
+	switch strings.ToUpper(m.Params[0]) {
+	case "LS":
+		if c.User == nil {
+			c.capNegotiating = true
+		}
+		if len(m.Params) > 1 {
+			if v, err := strconv.Atoi(m.Params[1]); err == nil && v >= 302 {
+				// 302 implies cap-notify.
+				c.capVersion = 302
+				c.caps.set("cap-notify", true)
+			}
+		}
+		var ls []string
+		for _, cp := range capabilities {
+			if c.capVersion >= 302 && len(cp.Value) > 0 {
+				ls = append(ls, cp.Name+"="+cp.Value)
+			} else {
+				ls = append(ls, cp.Name)
+			}
+		}
+		c.capList("LS", ls)
+
+	case "LIST":
+		c.capList("LIST", c.caps.list())
+
+	case "REQ":
+		if c.User == nil {
+			c.capNegotiating = true
+		}
+		req := ""
+		if len(m.Params) > 1 {
+			req = m.Params[1]
+		}
+		// All or nothing, check everything is valid first.
+		caps := strings.Fields(req)
+		for _, name := range caps {
+			if !supportedCap(strings.TrimPrefix(name, "-")) {
+				c.capReply("NAK", req)
+				return nil
+			}
+		}
+		for _, name := range caps {
+			if name[0] == '-' {
+				c.caps.set(name[1:], false)
+			} else {
+				c.caps.set(name, true)
+			}
+		}
+		c.capReply("ACK", req)
+
+	case "END":
+		if c.User == nil {
+			c.capNegotiating = false
+			c.maybeConnect()
+		}
+
+	default:
+		c.reply("410" /* ERR_INVALIDCAPCMD, not in RFC2812 */, m.Params[0], "Invalid CAP command")
+	}
+	return nil
+}
+
+func (c *Client) capReply(params ...string) {
+	nick := "*"
+	if len(c.nick) > 0 {
+		nick = c.nick
+	}
+	c.send(&irc.Message{
+		Prefix:  &irc.Prefix{Name: c.Server.Name},
+		Command: "CAP",
+		Params:  append([]string{nick}, params...)})
+}
+
+// capList sends a list of capabilities, split over multiple lines if needed
+// (only possible for CAP 302 clients).
+func (c *Client) capList(sub string, caps []string) {
+	// Leave enough room for the prefix, nick and subcommand.
+	max := maxLineLength - len(c.Server.Name) - 40
+	var line string
+	for _, cp := range caps {
+		if c.capVersion >= 302 && len(line) > 0 && len(line)+1+len(cp) > max {
+			c.capReply(sub, "*", line)
+			line = ""
+		}
+		if len(line) > 0 {
+			line += " "
+		}
+		line += cp
+	}
+	c.capReply(sub, line)
+}
@@ -0,0 +1,44 @@
+package irc
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCapNegotiation(t *testing.T) {
+	_, addr := newTestServer(t)
+	tc := dialTest(t, addr)
+
+	tc.send("CAP LS 302")
+	ls := tc.expect("CAP")
+	if ls.Params[1] != "LS" || !strings.Contains(" "+ls.Params[2]+" ", " sasl=PLAIN ") {
+		t.Errorf("CAP LS 302 = %v, want sasl=PLAIN", ls)
+	}
+
+	// Registration waits for CAP END.
+	tc.send("NICK alice")
+	tc.send("USER alice 0 * :Alice")
+	tc.send("CAP REQ :multi-prefix unknown-cap")
+	if m := tc.read(); m.Command != "CAP" || m.Params[1] != "NAK" {
+		t.Errorf("CAP REQ with unknown cap = %v, want NAK", m)
+	}
+	tc.send("CAP REQ :multi-prefix userhost-in-names")
+	if m := tc.read(); m.Command != "CAP" || m.Params[1] != "ACK" || m.Params[2] != "multi-prefix userhost-in-names" {
+		t.Errorf("CAP REQ = %v, want ACK", m)
+	}
+	tc.send("CAP REQ -userhost-in-names")
+	if m := tc.read(); m.Command != "CAP" || m.Params[1] != "ACK" {
+		t.Errorf("CAP REQ -userhost-in-names = %v, want ACK", m)
+	}
+	tc.send("CAP END")
+	if m := tc.read(); m.Command != "001" {
+		t.Errorf("after CAP END got %v, want RPL_WELCOME", m)
+	}
+	tc.expect("422")
+
+	// cap-notify is implied by 302.
+	tc.send("CAP LIST")
+	if m := tc.expect("CAP"); m.Params[2] != "cap-notify multi-prefix" {
+		t.Errorf("CAP LIST = %v, want cap-notify multi-prefix", m)
+	}
+}
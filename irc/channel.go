@@ -1,8 +1,15 @@
 package irc
 
 import (
+	"fmt"
 	"log"
+	"sort"
+	"strconv"
 	"strings"
+	"text/template"
+	"time"
+
+	"github.com/dgl/redisircd/ircbuf"
 
 	"gopkg.in/sorcix/irc.v2"
 )
@@ -10,27 +17,171 @@ import (
 // chanServer runs in a goroutine and manages channels
 type chanServer struct {
 	channels map[string]*channel
-	server   *Server
-	sendCh   chan<- chanRequest
+	responder
+	sendCh chan<- chanRequest
 }
 
 type channel struct {
 	Name       string
-	Users      map[*User]struct{}
+	Users      map[*User]memberModes
 	SimpleMode chanModes
 
-	redisPubsub                             chan<- *irc.Message
+	topic, topicBy string
+	topicTime      time.Time
+
+	key     string
+	limit   int
+	invites map[*User]struct{}
+
+	redisPubsub                             *redisSub
+	redisName                               string
 	redisType, redisTextPath, redisNickPath string
 	redisPublish                            bool
+	// Publish as JSON, including the sender's account
+	redisPublishJSON bool
+	// JSONPath to the timestamp of a message, for server-time
+	redisTimePath string
+	// Extra JSONPaths sent as client tags, the mode parameter and parsed form
+	redisTagsParam string
+	redisTags      []redisTagPath
+	// Redis key to poll for the topic, or JSONPath if it starts with "$"
+	redisTopic string
+	// Maximum lines sent from one Redis payload, 0 for no limit
+	redisMaxLines int
+	// Encoding of Redis payloads that aren't UTF-8
+	redisEncoding string
+	// Template to format JSON payloads, the mode parameter and parsed form
+	redisTemplateParam string
+	redisTemplate      *template.Template
+
+	// Ban (b), exception (e) and invite exception (I) lists
+	lists map[rune][]listEntry
+
+	// Nicks seen on messages from Redis, with the time last seen
+	redisNicks map[string]time.Time
+	// Rate of messages from Redis
+	redisRate msgRate
+}
+
+// redisTagPath is a client tag set from a JSONPath in the payload (+X)
+type redisTagPath struct {
+	Name, Path string
+}
+
+// parseTagPaths parses name=path[,name=path...] as given to +X.
+func parseTagPaths(p string) ([]redisTagPath, bool) {
+	var tps []redisTagPath
+	for _, tp := range strings.Split(p, ",") {
+		kv := strings.SplitN(tp, "=", 2)
+		if len(kv) != 2 || !validTagName(kv[0]) || len(kv[1]) == 0 {
+			return nil, false
+		}
+		tps = append(tps, redisTagPath{Name: kv[0], Path: kv[1]})
+	}
+	return tps, true
+}
+
+// listEntry is an entry in one of the channel's mask lists
+type listEntry struct {
+	Mask, SetBy string
+	Time        time.Time
+}
+
+// listModes are the list modes and numerics used to send them
+var listModes = map[rune]struct{ item, end, endText string }{
+	'b': {irc.RPL_BANLIST, irc.RPL_ENDOFBANLIST, "End of channel ban list"},
+	'e': {irc.RPL_EXCEPTLIST, irc.RPL_ENDOFEXCEPTLIST, "End of channel exception list"},
+	'I': {irc.RPL_INVITELIST, irc.RPL_ENDOFINVITELIST, "End of channel invite list"},
 }
 
+const (
+	// Number of Redis nicks remembered per channel
+	maxRedisNicks = 100
+	// Maximum entries in each list mode, advertised as MAXLIST
+	maxListEntries = 100
+	// Maximum topic length, advertised as TOPICLEN
+	topicLen = 390
+)
+
 type chanModes int
 
 const (
-	CM_NONE chanModes = iota << 1
-	CM_NOEXT
+	CM_NONE  chanModes = 0
+	CM_NOEXT chanModes = 1 << iota
+	CM_INVITE
+	CM_MODERATED
+)
+
+// simpleModes are the mode characters for chanModes
+var simpleModes = map[rune]chanModes{
+	'i': CM_INVITE,
+	'm': CM_MODERATED,
+	'n': CM_NOEXT,
+}
+
+// chanModeTypes are all the channel modes (apart from memberModeChars) by
+// CHANMODES type: lists, always with a parameter, with a parameter only when
+// set and never with a parameter.
+var chanModeTypes = [4]string{"beI", "NSTk", "EFKLRXl", "AJPimn"}
+
+// chanModeInfo returns all the channel modes and those with a parameter, as
+// shown in RPL_MYINFO.
+func chanModeInfo() (all, param string) {
+	param = chanModeTypes[0] + chanModeTypes[1] + chanModeTypes[2] + "ov"
+	all = param + chanModeTypes[3]
+	return sortModes(all), sortModes(param)
+}
+
+func sortModes(modes string) string {
+	r := []rune(modes)
+	sort.Slice(r, func(i, j int) bool { return r[i] < r[j] })
+	return string(r)
+}
+
+// memberModes are the modes a user has on a particular channel
+type memberModes int
+
+const (
+	MM_OP memberModes = 1 << iota
+	MM_VOICE
 )
 
+// memberModeChars are the mode characters for memberModes
+var memberModeChars = map[rune]memberModes{
+	'o': MM_OP,
+	'v': MM_VOICE,
+}
+
+// prefix is the highest prefix, as shown in NAMES and WHO
+func (mm memberModes) prefix() string {
+	if mm&MM_OP == MM_OP {
+		return "@"
+	} else if mm&MM_VOICE == MM_VOICE {
+		return "+"
+	}
+	return ""
+}
+
+// prefixes is all the prefixes, for clients with multi-prefix
+func (mm memberModes) prefixes() string {
+	p := ""
+	if mm&MM_OP == MM_OP {
+		p += "@"
+	}
+	if mm&MM_VOICE == MM_VOICE {
+		p += "+"
+	}
+	return p
+}
+
+// prefixFor is the prefix (or prefixes) to show to the user
+func (mm memberModes) prefixFor(user *User) string {
+	if user.hasCap("multi-prefix") {
+		return mm.prefixes()
+	}
+	return mm.prefix()
+}
+
 type chanReqType int
 
 const (
@@ -40,22 +191,40 @@ const (
 	CR_MODE
 	CR_LEAVE
 	CR_QUIT
+	CR_NICK
+	CR_WHO
+	CR_WHOIS
+	CR_TOPIC
+	CR_NAMES
+	CR_LIST
+	CR_KICK
+	CR_INVITE
+	CR_TAGMSG
+	CR_HISTORY
+	CR_LABEL
+	CR_SYNC
+	CR_NOTIFY
+	CR_LUSERS
+	CR_CTCP
 )
 
 type chanRequest struct {
 	Type   chanReqType
 	Name   string
 	User   *User
+	Target *User
 	Params []string
+	Tags   ircbuf.Tags
+	Reply  chan bool
 }
 
 func NewChanServer(server *Server) *chanServer {
 	reqCh := make(chan chanRequest, 100)
 
 	cs := &chanServer{
-		channels: make(map[string]*channel),
-		server:   server,
-		sendCh:   reqCh,
+		channels:  make(map[string]*channel),
+		responder: responder{server: server, labels: make(map[*User]string)},
+		sendCh:    reqCh,
 	}
 	go cs.run(reqCh)
 	return cs
@@ -64,37 +233,147 @@ func NewChanServer(server *Server) *chanServer {
 func (cs *chanServer) run(reqCh <-chan chanRequest) {
 	for req := range reqCh {
 		ch, chOk := cs.channels[strings.ToLower(req.Name)]
+		cs.current = req.User
 
 		switch req.Type {
 		case CR_JOIN:
 			if !chOk {
 				// Need to create it
 				ch = &channel{
-					Name:  req.Name,
-					Users: make(map[*User]struct{}),
+					Name:       req.Name,
+					Users:      make(map[*User]memberModes),
+					invites:    make(map[*User]struct{}),
+					lists:      make(map[rune][]listEntry),
+					redisNicks: make(map[string]time.Time),
 				}
 				cs.channels[strings.ToLower(req.Name)] = ch
 			}
 			if _, ok := ch.Users[req.User]; !ok {
-				// User not already in channel
-				ch.join(req.User, cs.server)
+				key := ""
+				if len(req.Params) > 0 {
+					key = req.Params[0]
+				}
+				if !ch.canJoin(req.User, key, cs.server) {
+					break
+				}
+				// User not already in channel, first user gets ops
+				var mm memberModes
+				if !chOk {
+					mm = MM_OP
+				}
+				ch.join(req.User, mm, cs.server)
 			}
-			if !chOk && len(req.Name) > 1 {
-				ch.mode(nil, []string{"+RP", strings.ToLower(req.Name)[1:]}, cs.server)
+			if !chOk {
+				if len(req.Name) > 1 {
+					ch.mode(nil, []string{"+nRP", strings.ToLower(req.Name)[1:]}, cs.server)
+				} else {
+					ch.mode(nil, []string{"+n"}, cs.server)
+				}
 			}
 		case CR_QUIT:
 			// Have to handle quit differently to leave, as it's not channel specific.
 			cs.quit(req.User, req.Params)
+			delete(cs.labels, req.User)
+
+		case CR_NICK:
+			cs.nick(req.User, req.Params)
 
-		case CR_PRIVMSG, CR_NOTICE:
+		case CR_WHO:
 			if chOk {
-				ch.msg(req.Type, req.User, req.Params)
+				_, member := ch.Users[req.User]
+				for u, mm := range ch.Users {
+					if member || !u.hasMode(UM_INVISIBLE) {
+						cs.whoReply(req.User, u, ch.Name, mm.prefixFor(req.User))
+					}
+				}
+			}
+			cs.reply(req.User, irc.RPL_ENDOFWHO, req.Name, "End of WHO list")
+
+		case CR_WHOIS:
+			cs.whois(req.User, req.Target, req.Name)
+
+		case CR_NAMES:
+			if chOk {
+				ch.names(req.User, cs.server)
+			} else {
+				cs.reply(req.User, irc.RPL_ENDOFNAMES, req.Name, "End of NAMES list")
+			}
+
+		case CR_LIST:
+			cs.list(req.User, req.Params)
+
+		case CR_KICK:
+			if chOk {
+				ch.kick(req.User, req.Params, cs.server)
+				cs.maybeDelete(ch)
+			} else {
+				cs.sendTo(req.User, &irc.Message{
+					Prefix:  &irc.Prefix{Name: cs.server.Name},
+					Command: irc.ERR_NOSUCHCHANNEL,
+					Params:  []string{req.User.Nick, req.Name, "No such channel"}})
+			}
+
+		case CR_INVITE:
+			if chOk {
+				ch.invite(req.User, req.Target, cs.server)
+			} else {
+				cs.sendTo(req.User, &irc.Message{
+					Prefix:  &irc.Prefix{Name: cs.server.Name},
+					Command: irc.ERR_NOSUCHCHANNEL,
+					Params:  []string{req.User.Nick, req.Name, "No such channel"}})
+			}
+
+		case CR_TOPIC:
+			if chOk {
+				if req.Params == nil {
+					ch.topicSend(req.User, true, cs.server)
+				} else {
+					ch.setTopic(req.User, req.Params[0], cs.server)
+				}
+			} else if !req.User.virtual() {
+				cs.sendTo(req.User, &irc.Message{
+					Prefix:  &irc.Prefix{Name: cs.server.Name},
+					Command: irc.ERR_NOSUCHCHANNEL,
+					Params:  []string{req.User.Nick, req.Name, "No such channel"}})
+			}
+
+		case CR_PRIVMSG, CR_NOTICE, CR_TAGMSG:
+			if chOk {
+				ch.msg(req.Type, req.User, req.Params, req.Tags, cs.server)
 			} else {
-				req.User.Send(&irc.Message{
+				cs.sendTo(req.User, &irc.Message{
 					Prefix:  &irc.Prefix{Name: cs.server.Name},
 					Command: irc.ERR_NOSUCHCHANNEL,
 					Params:  []string{req.User.Nick, req.Name, "No such channel"}})
 			}
+		case CR_HISTORY:
+			// Only members can see history, the client then queries Redis.
+			member := false
+			if chOk {
+				_, member = ch.Users[req.User]
+			}
+			req.Reply <- member
+		case CR_LABEL:
+			cs.labels[req.User] = req.Params[0]
+			req.Reply <- true
+		case CR_SYNC:
+			if label, ok := cs.labels[req.User]; ok {
+				delete(cs.labels, req.User)
+				req.User.labelEnd(label)
+			}
+			req.Reply <- true
+		case CR_LUSERS:
+			users, _ := strconv.Atoi(req.Params[0])
+			invisible, _ := strconv.Atoi(req.Params[1])
+			cs.lusers(req.User, users, invisible)
+			req.Reply <- true
+		case CR_NOTIFY:
+			cs.notify(req.User, req.Params[0], &irc.Message{
+				Prefix:  req.User.Prefix,
+				Command: req.Params[1],
+				Params:  req.Params[2:]})
+		case CR_CTCP:
+			cs.ctcp(req.User, req.Name, req.Params, req.Tags)
 		case CR_MODE:
 			if chOk {
 				if req.Params == nil {
@@ -103,7 +382,7 @@ func (cs *chanServer) run(reqCh <-chan chanRequest) {
 					ch.mode(req.User, req.Params, cs.server)
 				}
 			} else {
-				req.User.Send(&irc.Message{
+				cs.sendTo(req.User, &irc.Message{
 					Prefix:  &irc.Prefix{Name: cs.server.Name},
 					Command: irc.ERR_NOSUCHCHANNEL,
 					Params:  []string{req.User.Nick, req.Name, "No such channel"}})
@@ -111,11 +390,9 @@ func (cs *chanServer) run(reqCh <-chan chanRequest) {
 		case CR_LEAVE:
 			if chOk {
 				ch.leave(req.User, req.Params, cs.server)
-				if len(ch.Users) == 0 {
-					delete(cs.channels, strings.ToLower(req.Name))
-				}
+				cs.maybeDelete(ch)
 			} else {
-				req.User.Send(&irc.Message{
+				cs.sendTo(req.User, &irc.Message{
 					Prefix:  &irc.Prefix{Name: cs.server.Name},
 					Command: irc.ERR_NOSUCHCHANNEL,
 					Params:  []string{req.User.Nick, req.Name, "No such channel"}})
@@ -128,8 +405,24 @@ func (cs *chanServer) send(req chanRequest) {
 	cs.sendCh <- req
 }
 
+// maybeDelete deletes the channel once the last user has left, stopping any
+// Redis subscription.
+func (cs *chanServer) maybeDelete(ch *channel) {
+	if len(ch.Users) > 0 {
+		return
+	}
+	if ch.redisPubsub != nil {
+		ch.redisPubsub.close()
+		ch.redisPubsub = nil
+	}
+	delete(cs.channels, strings.ToLower(ch.Name))
+}
+
 func (cs *chanServer) quit(user *User, params []string) {
 	um := map[*User]struct{}{}
+	for _, ch := range cs.channels {
+		delete(ch.invites, user)
+	}
 	for ch := range user.Channels {
 		for u := range ch.Users {
 			if u != user {
@@ -137,9 +430,7 @@ func (cs *chanServer) quit(user *User, params []string) {
 			}
 		}
 		delete(ch.Users, user)
-		if len(ch.Users) == 0 {
-			delete(cs.channels, strings.ToLower(ch.Name))
-		}
+		cs.maybeDelete(ch)
 	}
 	msg := &irc.Message{
 		Prefix:  user.Prefix,
@@ -147,13 +438,209 @@ func (cs *chanServer) quit(user *User, params []string) {
 		Params:  []string{params[0]},
 	}
 	for u := range um {
-		u.Send(msg)
+		cs.sendTo(u, msg)
 	}
 	user.Channels = nil
 }
 
-func (ch *channel) join(user *User, server *Server) {
-	ch.Users[user] = struct{}{}
+// notify sends msg to everyone sharing a channel with the user whose client
+// has enabled the capability, e.g. AWAY for away-notify.
+func (cs *chanServer) notify(user *User, capability string, msg *irc.Message) {
+	um := map[*User]struct{}{}
+	for ch := range user.Channels {
+		for u := range ch.Users {
+			if u != user && u.hasCap(capability) {
+				um[u] = struct{}{}
+			}
+		}
+	}
+	for u := range um {
+		cs.sendTo(u, msg)
+	}
+}
+
+// nick tells the user and everyone sharing a channel with them about a nick
+// change. params are the old prefix and the new nick.
+func (cs *chanServer) nick(user *User, params []string) {
+	um := map[*User]struct{}{user: {}}
+	for ch := range user.Channels {
+		for u := range ch.Users {
+			um[u] = struct{}{}
+		}
+	}
+	msg := &irc.Message{
+		Prefix:  irc.ParsePrefix(params[0]),
+		Command: "NICK",
+		Params:  []string{params[1]},
+	}
+	for u := range um {
+		cs.sendTo(u, msg)
+	}
+}
+
+// whois replies with information on target, or if target is nil any Redis
+// nick matching nick.
+func (cs *chanServer) whois(user, target *User, nick string) {
+	server := cs.server
+	if target == nil {
+		var chans, pubsubs []string
+		for _, ch := range cs.channels {
+			if _, ok := ch.redisNicks[strings.ToLower(nick)]; ok {
+				chans = append(chans, ch.Name)
+				pubsubs = append(pubsubs, ch.redisName)
+			}
+		}
+		if len(chans) == 0 {
+			cs.reply(user, irc.ERR_NOSUCHNICK, nick, "No such nick/channel")
+			cs.reply(user, irc.RPL_ENDOFWHOIS, nick, "End of WHOIS list")
+			return
+		}
+		cs.reply(user, irc.RPL_WHOISUSER, nick, "auto", "redis", "*", "Redis pubsub")
+		cs.reply(user, irc.RPL_WHOISCHANNELS, nick, strings.Join(chans, " "))
+		cs.reply(user, irc.RPL_WHOISSERVER, nick, server.Name, NAME)
+		cs.reply(user, "320" /* RPL_WHOISSPECIAL, not in RFC2812 */, nick,
+			"is a virtual user from Redis pubsub "+strings.Join(pubsubs, " "))
+		cs.reply(user, irc.RPL_ENDOFWHOIS, nick, "End of WHOIS list")
+		return
+	}
+
+	cs.reply(user, irc.RPL_WHOISUSER, target.Nick, target.Prefix.User, target.Prefix.Host, "*", target.realname())
+	if len(target.Channels) > 0 {
+		var chans []string
+		for ch := range target.Channels {
+			chans = append(chans, ch.Users[target].prefixFor(user)+ch.Name)
+		}
+		cs.reply(user, irc.RPL_WHOISCHANNELS, target.Nick, strings.Join(chans, " "))
+	}
+	cs.reply(user, irc.RPL_WHOISSERVER, target.Nick, server.Name, NAME)
+	if len(target.Away) > 0 {
+		cs.reply(user, irc.RPL_AWAY, target.Nick, target.Away)
+	}
+	if target.hasMode(UM_BOT) {
+		cs.reply(user, "335" /* RPL_WHOISBOT, not in RFC2812 */, target.Nick, "is a bot")
+	}
+	if len(target.Account) > 0 {
+		cs.reply(user, "330" /* RPL_WHOISACCOUNT, not in RFC2812 */, target.Nick, target.Account, "is logged in as")
+	}
+	c := target.client
+	idle := int(c.idle() / time.Second)
+	cs.reply(user, irc.RPL_WHOISIDLE, target.Nick, fmt.Sprint(idle), fmt.Sprint(c.signon.Unix()),
+		"seconds idle, signon time")
+	cs.reply(user, irc.RPL_ENDOFWHOIS, target.Nick, "End of WHOIS list")
+}
+
+// list replies with channels matching the ELIST style conditions given in
+// params: "<n" and ">n" for user counts, "!mask" to exclude and masks (or
+// names) to include.
+func (cs *chanServer) list(user *User, params []string) {
+	var masks, notMasks []string
+	minUsers, maxUsers := -1, -1
+	if len(params) > 0 && len(params[0]) > 0 {
+		for _, cond := range strings.Split(params[0], ",") {
+			if len(cond) == 0 {
+				continue
+			}
+			switch cond[0] {
+			case '>':
+				minUsers, _ = strconv.Atoi(cond[1:])
+			case '<':
+				if n, err := strconv.Atoi(cond[1:]); err == nil {
+					maxUsers = n
+				}
+			case '!':
+				notMasks = append(notMasks, cond[1:])
+			default:
+				masks = append(masks, cond)
+			}
+		}
+	}
+
+	now := time.Now()
+	cs.reply(user, irc.RPL_LISTSTART, "Channel", "Users  Name")
+Channels:
+	for _, ch := range cs.channels {
+		n := len(ch.Users)
+		if n <= minUsers || (maxUsers >= 0 && n >= maxUsers) {
+			continue
+		}
+		for _, m := range notMasks {
+			if matchMask(m, ch.Name) {
+				continue Channels
+			}
+		}
+		if len(masks) > 0 {
+			found := false
+			for _, m := range masks {
+				if matchMask(m, ch.Name) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				continue
+			}
+		}
+
+		topic := ch.topic
+		if ch.redisPubsub != nil {
+			topic = strings.TrimSpace(fmt.Sprintf("[redis %s, %.1f msg/min] %s",
+				ch.redisName, ch.redisRate.perMinute(now), topic))
+		}
+		cs.reply(user, irc.RPL_LIST, ch.Name, strconv.Itoa(n), topic)
+	}
+	cs.reply(user, irc.RPL_LISTEND, "End of LIST")
+}
+
+// canJoin checks the channel's restrictions, replying with the reason if the
+// user cannot join.
+func (ch *channel) canJoin(user *User, key string, server *Server) bool {
+	if ch.banned(user) {
+		server.cs.reply(user, irc.ERR_BANNEDFROMCHAN, ch.Name, "Cannot join channel (+b)")
+		return false
+	}
+	if ch.SimpleMode&CM_INVITE == CM_INVITE {
+		if _, ok := ch.invites[user]; !ok && !ch.matchList('I', user) {
+			server.cs.reply(user, irc.ERR_INVITEONLYCHAN, ch.Name, "Cannot join channel (+i)")
+			return false
+		}
+	}
+	if len(ch.key) > 0 && key != ch.key {
+		server.cs.reply(user, irc.ERR_BADCHANNELKEY, ch.Name, "Cannot join channel (+k)")
+		return false
+	}
+	if ch.limit > 0 && len(ch.Users) >= ch.limit {
+		server.cs.reply(user, irc.ERR_CHANNELISFULL, ch.Name, "Cannot join channel (+l)")
+		return false
+	}
+	return true
+}
+
+func (ch *channel) invite(user, target *User, server *Server) {
+	if _, ok := ch.Users[user]; !ok {
+		server.cs.reply(user, irc.ERR_NOTONCHANNEL, ch.Name, "You're not on that channel")
+		return
+	}
+	if ch.SimpleMode&CM_INVITE == CM_INVITE && !ch.isOp(user) {
+		server.cs.reply(user, irc.ERR_CHANOPRIVSNEEDED, ch.Name, "You're not channel operator")
+		return
+	}
+	if _, ok := ch.Users[target]; ok {
+		server.cs.reply(user, irc.ERR_USERONCHANNEL, target.Nick, ch.Name, "is already on channel")
+		return
+	}
+
+	ch.invites[target] = struct{}{}
+	server.cs.reply(user, irc.RPL_INVITING, target.Nick, ch.Name)
+	server.cs.sendTo(target, &irc.Message{
+		Prefix:  user.Prefix,
+		Command: "INVITE",
+		Params:  []string{target.Nick, ch.Name},
+	})
+}
+
+func (ch *channel) join(user *User, mm memberModes, server *Server) {
+	delete(ch.invites, user)
+	ch.Users[user] = mm
 	user.Channels[ch] = struct{}{}
 
 	msg := &irc.Message{
@@ -162,33 +649,108 @@ func (ch *channel) join(user *User, server *Server) {
 		Params:  []string{ch.Name},
 	}
 	for u := range ch.Users {
-		u.Send(msg)
+		server.cs.sendTo(u, msg)
+	}
+	if len(user.Away) > 0 {
+		away := &irc.Message{
+			Prefix:  user.Prefix,
+			Command: "AWAY",
+			Params:  []string{user.Away},
+		}
+		for u := range ch.Users {
+			if u != user && u.hasCap("away-notify") {
+				server.cs.sendTo(u, away)
+			}
+		}
 	}
 
+	ch.topicSend(user, false, server)
+
+	ch.names(user, server)
+}
+
+// names sends RPL_NAMREPLY, split over as many lines as needed.
+func (ch *channel) names(user *User, server *Server) {
 	sp := &irc.Prefix{Name: server.Name}
-	// TODO: split names into multiple lines if needed
+	max := maxLineLength - len(":"+server.Name+" "+irc.RPL_NAMREPLY+" "+user.Nick+" = "+ch.Name+" :")
+
 	var sb strings.Builder
-	i := 0
-	for u := range ch.Users {
-		if i > 0 {
+	send := func() {
+		server.cs.sendTo(user, &irc.Message{
+			Prefix:  sp,
+			Command: irc.RPL_NAMREPLY,
+			Params:  []string{user.Nick, "=", ch.Name, sb.String()}})
+		sb.Reset()
+	}
+	userhost := user.hasCap("userhost-in-names")
+	_, member := ch.Users[user]
+	for u, mm := range ch.Users {
+		if !member && u.hasMode(UM_INVISIBLE) {
+			continue
+		}
+		name := mm.prefixFor(user) + u.Nick
+		if userhost {
+			name = mm.prefixFor(user) + u.Prefix.String()
+		}
+		if sb.Len() > 0 && sb.Len()+1+len(name) > max {
+			send()
+		}
+		if sb.Len() > 0 {
 			sb.WriteRune(' ')
 		}
-		sb.WriteString(u.Nick)
-		i++
+		sb.WriteString(name)
 	}
-	user.Send(&irc.Message{
-		Prefix:  sp,
-		Command: irc.RPL_NAMREPLY,
-		Params:  []string{user.Nick, "=", ch.Name, sb.String()}})
-	user.Send(&irc.Message{
+	if sb.Len() > 0 {
+		send()
+	}
+	server.cs.sendTo(user, &irc.Message{
 		Prefix:  sp,
 		Command: irc.RPL_ENDOFNAMES,
 		Params:  []string{user.Nick, ch.Name, "End of NAMES list"}})
 }
 
+// topicSend sends the topic to the user, if there is no topic RPL_NOTOPIC is
+// only sent if explicit is set.
+func (ch *channel) topicSend(user *User, explicit bool, server *Server) {
+	if len(ch.topic) == 0 {
+		if explicit {
+			server.cs.reply(user, irc.RPL_NOTOPIC, ch.Name, "No topic is set")
+		}
+		return
+	}
+	server.cs.reply(user, irc.RPL_TOPIC, ch.Name, ch.topic)
+	server.cs.reply(user, irc.RPL_TOPICWHOTIME, ch.Name, ch.topicBy, fmt.Sprint(ch.topicTime.Unix()))
+}
+
+// setTopic changes the topic, user may be a virtual user when the topic comes
+// from Redis.
+func (ch *channel) setTopic(user *User, topic string, server *Server) {
+	if _, ok := ch.Users[user]; !ok && !user.virtual() {
+		server.cs.reply(user, irc.ERR_NOTONCHANNEL, ch.Name, "You're not on that channel")
+		return
+	}
+
+	topic = truncateUTF8(topic, topicLen)
+	if topic == ch.topic {
+		return
+	}
+	ch.topic = topic
+	ch.topicBy = user.Prefix.String()
+	ch.topicTime = time.Now()
+
+	msg := &irc.Message{
+		Prefix:  user.Prefix,
+		Command: "TOPIC",
+		Params:  []string{ch.Name, topic},
+	}
+	for u := range ch.Users {
+		server.cs.sendTo(u, msg)
+	}
+}
+
 func (ch *channel) leave(user *User, params []string, server *Server) {
 	if _, ok := ch.Users[user]; !ok {
-		user.Send(&irc.Message{
+		server.cs.sendTo(user, &irc.Message{
 			Prefix:  &irc.Prefix{Name: server.Name},
 			Command: irc.ERR_NOTONCHANNEL,
 			Params:  []string{user.Nick, ch.Name, "You're not on that channel"}})
@@ -204,35 +766,243 @@ func (ch *channel) leave(user *User, params []string, server *Server) {
 		Params:  []string{ch.Name, params[0]},
 	}
 	for u := range ch.Users {
-		u.Send(msg)
+		server.cs.sendTo(u, msg)
+	}
+}
+
+// member finds a user on the channel by nick
+func (ch *channel) member(nick string) *User {
+	for u := range ch.Users {
+		if strings.ToLower(u.Nick) == strings.ToLower(nick) {
+			return u
+		}
+	}
+	return nil
+}
+
+// isOp is true if the user is a channel operator, a nil user is the server
+// itself.
+func (ch *channel) isOp(user *User) bool {
+	return user == nil || ch.Users[user]&MM_OP == MM_OP
+}
+
+// banned is true if the user matches a ban (+b) without an exception (+e)
+func (ch *channel) banned(user *User) bool {
+	return ch.matchList('b', user) && !ch.matchList('e', user)
+}
+
+func (ch *channel) matchList(mode rune, user *User) bool {
+	prefix := user.Prefix.String()
+	for _, e := range ch.lists[mode] {
+		if matchMask(e.Mask, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (ch *channel) listSend(user *User, mode rune, server *Server) {
+	lm := listModes[mode]
+	for _, e := range ch.lists[mode] {
+		server.cs.reply(user, lm.item, ch.Name, e.Mask, e.SetBy, fmt.Sprint(e.Time.Unix()))
+	}
+	server.cs.reply(user, lm.end, ch.Name, lm.endText)
+}
+
+// listChange adds or removes a mask from a list, returning true if the list
+// was changed.
+func (ch *channel) listChange(user *User, mode rune, add bool, mask string, server *Server) bool {
+	list := ch.lists[mode]
+	for i, e := range list {
+		if strings.ToLower(e.Mask) == strings.ToLower(mask) {
+			if add {
+				return false
+			}
+			ch.lists[mode] = append(list[:i], list[i+1:]...)
+			return true
+		}
+	}
+	if !add {
+		return false
+	}
+	if len(list) >= maxListEntries {
+		server.cs.reply(user, irc.ERR_BANLISTFULL, ch.Name, string(mode), "Channel list is full")
+		return false
+	}
+	setBy := server.Name
+	if user != nil {
+		setBy = user.Prefix.String()
+	}
+	ch.lists[mode] = append(list, listEntry{Mask: mask, SetBy: setBy, Time: time.Now()})
+	return true
+}
+
+func (ch *channel) kick(user *User, params []string, server *Server) {
+	if _, ok := ch.Users[user]; !ok {
+		server.cs.reply(user, irc.ERR_NOTONCHANNEL, ch.Name, "You're not on that channel")
+		return
+	}
+	if !ch.isOp(user) {
+		server.cs.reply(user, irc.ERR_CHANOPRIVSNEEDED, ch.Name, "You're not channel operator")
+		return
+	}
+
+	reason := user.Nick
+	if len(params) > 1 && len(params[1]) > 0 {
+		reason = params[1]
+	}
+
+	for _, nick := range strings.Split(params[0], ",") {
+		target := ch.member(nick)
+		if target == nil {
+			server.cs.reply(user, irc.ERR_USERNOTINCHANNEL, nick, ch.Name, "They aren't on that channel")
+			continue
+		}
+
+		msg := &irc.Message{
+			Prefix:  user.Prefix,
+			Command: "KICK",
+			Params:  []string{ch.Name, target.Nick, reason},
+		}
+		for u := range ch.Users {
+			server.cs.sendTo(u, msg)
+		}
+		delete(ch.Users, target)
+		delete(target.Channels, ch)
 	}
 }
 
-func (ch *channel) msg(t chanReqType, user *User, params []string) {
+// canSend checks if the user can send to the channel, replying with the reason
+// if not. Messages from Redis are always allowed, they're implicitly voiced.
+func (ch *channel) canSend(user *User, server *Server) bool {
+	if user.virtual() || ch.Users[user]&(MM_OP|MM_VOICE) != 0 {
+		return true
+	}
+	if _, ok := ch.Users[user]; !ok && ch.SimpleMode&CM_NOEXT == CM_NOEXT {
+		server.cs.reply(user, irc.ERR_CANNOTSENDTOCHAN, ch.Name, "Cannot send to channel (+n)")
+		return false
+	}
+	if ch.SimpleMode&CM_MODERATED == CM_MODERATED {
+		server.cs.reply(user, irc.ERR_CANNOTSENDTOCHAN, ch.Name, "Cannot send to channel (+m)")
+		return false
+	}
+	if ch.banned(user) {
+		server.cs.reply(user, irc.ERR_CANNOTSENDTOCHAN, ch.Name, "Cannot send to channel (+b)")
+		return false
+	}
+	return true
+}
+
+// msg sends a message to the channel, tags are client-only tags from the
+// sender or the time and msgid of messages from Redis.
+func (ch *channel) msg(t chanReqType, user *User, params []string, tags ircbuf.Tags, server *Server) {
 	cmd := "PRIVMSG"
 	if t == CR_NOTICE {
 		cmd = "NOTICE"
+	} else if t == CR_TAGMSG {
+		cmd = "TAGMSG"
+	}
+
+	if !ch.canSend(user, server) {
+		return
 	}
 
 	msg := &irc.Message{
 		Prefix:  user.Prefix,
 		Command: cmd,
-		Params:  []string{ch.Name, params[0]},
+		Params:  []string{ch.Name},
+	}
+	if len(params) > 0 {
+		msg.Params = append(msg.Params, params[0])
+	}
+	tags = messageTags(tags, time.Now())
+	if cmd != "TAGMSG" {
+		server.history.add(ch.Name, tags, msg)
 	}
 
-	if cmd == "PRIVMSG" && ch.redisPublish && ch.redisPubsub != nil {
-		ch.redisPubsub <- msg
+	if user.virtual() {
+		ch.seenRedisNick(user.Nick)
+		ch.redisRate.add(time.Now())
+	}
+
+	published := false
+	// Messages from Redis aren't published, to avoid loops.
+	if cmd == "PRIVMSG" && ch.redisPublish && !user.virtual() &&
+		ch.redisPubsub != nil && ch.redisPubsub.subscribed() {
+		text, action := params[0], false
+		if len(params) > 1 {
+			// CTCP, only actions are published, without the control characters.
+			text, action = params[2], params[1] == "ACTION"
+		}
+		if len(params) == 1 || action {
+			ch.redisPubsub.out <- pubsubLine(user, text, action, ch.redisPublishJSON)
+			published = true
+		}
 	}
 
 	for u := range ch.Users {
-		if u != user {
-			u.Send(msg)
+		if u == user || u.hasMode(UM_DEAF) || (cmd == "TAGMSG" && !u.hasCap("message-tags")) {
+			continue
+		}
+		server.cs.sendTagsTo(u, tags, msg)
+	}
+	if user.hasCap("echo-message") {
+		if published {
+			// Let the sender know it went to Redis too, without changing the
+			// tags everyone else was sent.
+			echo := ircbuf.Tags{"redisircd/published": ""}
+			for k, v := range tags {
+				echo[k] = v
+			}
+			tags = echo
 		}
+		server.cs.sendTagsTo(user, tags, msg)
+	}
+}
+
+func (ch *channel) seenRedisNick(nick string) {
+	ch.redisNicks[strings.ToLower(nick)] = time.Now()
+	if len(ch.redisNicks) <= maxRedisNicks {
+		return
+	}
+	oldest := ""
+	for n, t := range ch.redisNicks {
+		if oldest == "" || t.Before(ch.redisNicks[oldest]) {
+			oldest = n
+		}
+	}
+	delete(ch.redisNicks, oldest)
+}
+
+// redisConfig returns the settings used by the pubsub goroutine.
+func (ch *channel) redisConfig() redisConfig {
+	return redisConfig{
+		Type:     ch.redisType,
+		TextPath: ch.redisTextPath,
+		NickPath: ch.redisNickPath,
+		TimePath: ch.redisTimePath,
+		Tags:     ch.redisTags,
+		Topic:    ch.redisTopic,
+		MaxLines: ch.redisMaxLines,
+		Encoding: ch.redisEncoding,
+		Template: ch.redisTemplate,
 	}
 }
 
 func (ch *channel) modeSend(user *User, server *Server) {
 	mode := "+"
+	if ch.SimpleMode&CM_INVITE == CM_INVITE {
+		mode += "i"
+	}
+	if len(ch.key) > 0 {
+		mode += "k"
+	}
+	if ch.limit > 0 {
+		mode += "l"
+	}
+	if ch.SimpleMode&CM_MODERATED == CM_MODERATED {
+		mode += "m"
+	}
 	if ch.SimpleMode&CM_NOEXT == CM_NOEXT {
 		mode += "n"
 	}
@@ -245,11 +1015,32 @@ func (ch *channel) modeSend(user *User, server *Server) {
 	if ch.redisNickPath != "" {
 		mode += "N"
 	}
+	if ch.redisTimePath != "" {
+		mode += "S"
+	}
+	if ch.redisTagsParam != "" {
+		mode += "X"
+	}
 	if ch.redisTextPath != "" {
 		mode += "T"
 	}
+	if ch.redisTopic != "" {
+		mode += "K"
+	}
+	if ch.redisMaxLines > 0 {
+		mode += "L"
+	}
+	if ch.redisEncoding != "" {
+		mode += "E"
+	}
+	if ch.redisTemplateParam != "" {
+		mode += "F"
+	}
+	if ch.redisPublishJSON {
+		mode += "A"
+	}
 
-	user.Send(&irc.Message{
+	server.cs.sendTo(user, &irc.Message{
 		Prefix:  &irc.Prefix{Name: server.Name},
 		Command: irc.RPL_CHANNELMODEIS,
 		Params:  []string{user.Nick, ch.Name, mode}})
@@ -260,6 +1051,12 @@ func (ch *channel) mode(user *User, params []string, server *Server) {
 		return
 	}
 
+	// Anyone can look at the lists, Irssi asks for bans on join.
+	if !ch.isOp(user) && !(len(params) == 1 && strings.Trim(params[0], "+beI") == "") {
+		server.cs.reply(user, irc.ERR_CHANOPRIVSNEEDED, ch.Name, "You're not channel operator")
+		return
+	}
+
 	modes := params[0]
 	paramIdx := 1
 
@@ -271,25 +1068,97 @@ func (ch *channel) mode(user *User, params []string, server *Server) {
 		switch c {
 		case '+', '-':
 			state = c
-		case 'n':
+		case 'i', 'm', 'n':
+			flag := simpleModes[c]
 			old := ch.SimpleMode
 			if state == '+' {
-				ch.SimpleMode |= CM_NOEXT
+				ch.SimpleMode |= flag
 			} else {
-				ch.SimpleMode &= ^CM_NOEXT
+				ch.SimpleMode &= ^flag
 			}
 			if ch.SimpleMode != old {
 				modeChange.WriteRune(state)
 				modeChange.WriteRune(c)
 			}
-		case 'b':
-			// Just ignore for now, stops errors in Irssi
+		case 'k':
+			p := ""
+			if len(params) > paramIdx {
+				p = params[paramIdx]
+				paramIdx++
+			}
+			if state == '+' {
+				if !validKey(p) {
+					server.cs.reply(user, "525" /* ERR_INVALIDKEY, not in RFC2812 */, ch.Name, "Key is not well-formed")
+					continue
+				}
+				ch.key = p
+				modeChange.WriteRune(state)
+				modeChange.WriteRune(c)
+				modeParam = append(modeParam, p)
+			} else if len(ch.key) > 0 {
+				modeChange.WriteRune(state)
+				modeChange.WriteRune(c)
+				modeParam = append(modeParam, "*")
+				ch.key = ""
+			}
+		case 'l':
+			if state == '+' {
+				if len(params) > paramIdx {
+					p := params[paramIdx]
+					paramIdx++
+					if n, err := strconv.Atoi(p); err == nil && n > 0 {
+						ch.limit = n
+						modeChange.WriteRune(state)
+						modeChange.WriteRune(c)
+						modeParam = append(modeParam, strconv.Itoa(n))
+					}
+				}
+			} else if ch.limit > 0 {
+				ch.limit = 0
+				modeChange.WriteRune(state)
+				modeChange.WriteRune(c)
+			}
+		case 'b', 'e', 'I':
+			if len(params) > paramIdx {
+				p := normalizeMask(params[paramIdx])
+				paramIdx++
+				if ch.listChange(user, c, state == '+', p, server) {
+					modeChange.WriteRune(state)
+					modeChange.WriteRune(c)
+					modeParam = append(modeParam, p)
+				}
+			} else {
+				ch.listSend(user, c, server)
+			}
+
+		case 'o', 'v':
+			if len(params) > paramIdx {
+				p := params[paramIdx]
+				paramIdx++
+				target := ch.member(p)
+				if target == nil {
+					server.cs.reply(user, irc.ERR_USERNOTINCHANNEL, p, ch.Name, "They aren't on that channel")
+					continue
+				}
+				old := ch.Users[target]
+				if state == '+' {
+					ch.Users[target] |= memberModeChars[c]
+				} else {
+					ch.Users[target] &= ^memberModeChars[c]
+				}
+				if ch.Users[target] != old {
+					modeChange.WriteRune(state)
+					modeChange.WriteRune(c)
+					modeParam = append(modeParam, target.Nick)
+				}
+			}
 
 		// The Redis specific modes...
 		case 'R':
 			if ch.redisPubsub != nil {
-				close(ch.redisPubsub)
+				ch.redisPubsub.close()
 				ch.redisPubsub = nil
+				ch.redisName = ""
 				if state == '-' {
 					modeChange.WriteRune(state)
 					modeChange.WriteRune(c)
@@ -303,7 +1172,8 @@ func (ch *channel) mode(user *User, params []string, server *Server) {
 				modeChange.WriteRune(state)
 				modeChange.WriteRune(c)
 
-				ch.redisPubsub = redisPubsub(p, ch, server)
+				ch.redisPubsub = redisPubsub(p, ch.Name, server)
+				ch.redisName = p
 			}
 		case 'J':
 			if state == '+' {
@@ -329,6 +1199,45 @@ func (ch *channel) mode(user *User, params []string, server *Server) {
 				}
 			}
 
+		case 'X':
+			if state == '-' {
+				if ch.redisTagsParam != "" {
+					ch.redisTagsParam = ""
+					ch.redisTags = nil
+					modeChange.WriteRune(state)
+					modeChange.WriteRune(c)
+				}
+			} else if len(params) > paramIdx {
+				p := params[paramIdx]
+				paramIdx++
+				tps, ok := parseTagPaths(p)
+				if !ok {
+					server.cs.reply(user, "696" /* ERR_INVALIDMODEPARAM, not in RFC2812 */, ch.Name, string(c), p,
+						"Expected name=jsonpath[,name=jsonpath...]")
+					continue
+				}
+				modeChange.WriteRune(state)
+				modeChange.WriteRune(c)
+				modeParam = append(modeParam, p)
+				ch.redisTagsParam = p
+				ch.redisTags = tps
+			}
+
+		case 'S':
+			if len(params) > paramIdx {
+				p := params[paramIdx]
+				paramIdx++
+				modeChange.WriteRune(state)
+				modeChange.WriteRune(c)
+				modeParam = append(modeParam, p)
+
+				if state == '+' {
+					ch.redisTimePath = p
+				} else {
+					ch.redisTimePath = ""
+				}
+			}
+
 		case 'T':
 			if len(params) > paramIdx {
 				p := params[paramIdx]
@@ -344,11 +1253,101 @@ func (ch *channel) mode(user *User, params []string, server *Server) {
 				}
 			}
 
+		case 'K':
+			if state == '-' {
+				if ch.redisTopic != "" {
+					ch.redisTopic = ""
+					modeChange.WriteRune(state)
+					modeChange.WriteRune(c)
+				}
+			} else if len(params) > paramIdx {
+				p := params[paramIdx]
+				paramIdx++
+				modeChange.WriteRune(state)
+				modeChange.WriteRune(c)
+				modeParam = append(modeParam, p)
+				ch.redisTopic = p
+			}
+
+		case 'E':
+			if state == '-' {
+				if ch.redisEncoding != "" {
+					ch.redisEncoding = ""
+					modeChange.WriteRune(state)
+					modeChange.WriteRune(c)
+				}
+			} else if len(params) > paramIdx {
+				p := strings.ToLower(params[paramIdx])
+				paramIdx++
+				if !legacyEncodings[p] {
+					server.cs.reply(user, "696" /* ERR_INVALIDMODEPARAM, not in RFC2812 */, ch.Name, string(c), p,
+						"Expected latin1 or cp1252")
+					continue
+				}
+				modeChange.WriteRune(state)
+				modeChange.WriteRune(c)
+				modeParam = append(modeParam, p)
+				ch.redisEncoding = p
+			}
+
+		case 'F':
+			if state == '-' {
+				if ch.redisTemplateParam != "" {
+					ch.redisTemplateParam = ""
+					ch.redisTemplate = nil
+					modeChange.WriteRune(state)
+					modeChange.WriteRune(c)
+				}
+			} else if len(params) > paramIdx {
+				p := params[paramIdx]
+				paramIdx++
+				if strings.Contains(p, "{{") && paramIdx < len(params) {
+					// Only the last parameter can have spaces, anything after
+					// is likely the rest of a template that wasn't sent with ':'.
+					server.cs.reply(user, "696" /* ERR_INVALIDMODEPARAM, not in RFC2812 */, ch.Name, string(c), p,
+						"Inline template must be the last parameter")
+					continue
+				}
+				t, err := server.template(p)
+				if err != nil {
+					server.cs.reply(user, "696" /* ERR_INVALIDMODEPARAM, not in RFC2812 */, ch.Name, string(c), p, err.Error())
+					continue
+				}
+				modeChange.WriteRune(state)
+				modeChange.WriteRune(c)
+				modeParam = append(modeParam, p)
+				ch.redisTemplateParam = p
+				ch.redisTemplate = t
+			}
+
+		case 'L':
+			if state == '+' {
+				if len(params) > paramIdx {
+					p := params[paramIdx]
+					paramIdx++
+					if n, err := strconv.Atoi(p); err == nil && n > 0 {
+						ch.redisMaxLines = n
+						modeChange.WriteRune(state)
+						modeChange.WriteRune(c)
+						modeParam = append(modeParam, strconv.Itoa(n))
+					}
+				}
+			} else if ch.redisMaxLines > 0 {
+				ch.redisMaxLines = 0
+				modeChange.WriteRune(state)
+				modeChange.WriteRune(c)
+			}
+
 		case 'P':
 			ch.redisPublish = state == '+'
 			modeChange.WriteRune(state)
 			modeChange.WriteRune(c)
 
+		case 'A':
+			ch.redisPublishJSON = state == '+'
+			modeChange.WriteRune(state)
+			modeChange.WriteRune(c)
+
 		default:
 			bad = c
 			break
@@ -356,6 +1355,9 @@ func (ch *channel) mode(user *User, params []string, server *Server) {
 	}
 
 	mc := modeChange.String()
+	if len(mc) > 0 && ch.redisPubsub != nil {
+		ch.redisPubsub.update(ch.redisConfig())
+	}
 	// TODO: compress -/+ states
 	if len(mc) > 0 {
 		p := irc.ParsePrefix(server.Name)
@@ -368,12 +1370,12 @@ func (ch *channel) mode(user *User, params []string, server *Server) {
 			Params:  append([]string{ch.Name, mc}, modeParam...)}
 		log.Print(msg)
 		for u := range ch.Users {
-			u.Send(msg)
+			server.cs.sendTo(u, msg)
 		}
 	}
 
 	if bad != ' ' {
-		user.Send(&irc.Message{
+		server.cs.sendTo(user, &irc.Message{
 			Prefix:  &irc.Prefix{Name: server.Name},
 			Command: irc.ERR_UNKNOWNMODE,
 			Params:  []string{user.Nick, string(bad), "is an unknown mode character"}})
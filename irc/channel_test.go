@@ -0,0 +1,114 @@
+package irc
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestNamesSplit(t *testing.T) {
+	_, addr := newTestServer(t)
+	alice := register(t, addr, "alice")
+	alice.send("JOIN #x")
+	alice.sync()
+
+	want := map[string]bool{"@alice": true}
+	for i := 0; i < 50; i++ {
+		nick := fmt.Sprintf("user%08d", i)
+		u := register(t, addr, nick)
+		u.send("JOIN #x")
+		u.sync()
+		want[nick] = true
+	}
+
+	alice.sync()
+	alice.send("NAMES #x")
+	lines := 0
+	for {
+		m := alice.expect("353")
+		if l := len(m.String()); l > maxLineLength {
+			t.Errorf("RPL_NAMREPLY is %d bytes: %v", l, m)
+		}
+		lines++
+		for _, name := range strings.Fields(m.Params[3]) {
+			if !want[name] {
+				t.Errorf("unexpected name %q", name)
+			}
+			delete(want, name)
+		}
+		if len(want) == 0 {
+			break
+		}
+	}
+	if lines < 2 {
+		t.Errorf("NAMES sent in %d lines, want it split", lines)
+	}
+	alice.expect("366")
+}
+
+// joinTest has each user join #x in turn, so the first is the operator.
+func joinTest(t *testing.T, users ...*testClient) {
+	t.Helper()
+	for _, u := range users {
+		u.send("JOIN #x")
+		u.sync()
+	}
+	for _, u := range users {
+		u.sync()
+	}
+}
+
+func TestBans(t *testing.T) {
+	_, addr := newTestServer(t)
+	alice := register(t, addr, "alice")
+	bob := register(t, addr, "bob")
+	joinTest(t, alice, bob)
+
+	alice.send("MODE #x +b bob!*@*")
+	bob.expect("MODE")
+	bob.send("PRIVMSG #x :banned")
+	if m := bob.expect("404"); !strings.Contains(m.Params[2], "+b") {
+		t.Errorf("banned PRIVMSG = %v, want ERR_CANNOTSENDTOCHAN (+b)", m)
+	}
+
+	alice.send("MODE #x +e *!~bob@*")
+	bob.expect("MODE")
+	bob.send("PRIVMSG #x :excepted")
+	if m := alice.expect("PRIVMSG"); m.Params[1] != "excepted" {
+		t.Errorf("PRIVMSG = %v, want excepted", m)
+	}
+
+	carol := register(t, addr, "carol")
+	alice.send("MODE #x +b carol!*@*")
+	alice.expect("MODE")
+	carol.send("JOIN #x")
+	if m := carol.expect("474"); m.Params[1] != "#x" {
+		t.Errorf("banned JOIN = %v, want ERR_BANNEDFROMCHAN", m)
+	}
+}
+
+func TestModerated(t *testing.T) {
+	_, addr := newTestServer(t)
+	alice := register(t, addr, "alice")
+	bob := register(t, addr, "bob")
+	joinTest(t, alice, bob)
+
+	alice.send("MODE #x +m")
+	bob.expect("MODE")
+	bob.send("PRIVMSG #x :quiet")
+	if m := bob.expect("404"); !strings.Contains(m.Params[2], "+m") {
+		t.Errorf("moderated PRIVMSG = %v, want ERR_CANNOTSENDTOCHAN (+m)", m)
+	}
+
+	alice.send("PRIVMSG #x :op")
+	if m := bob.expect("PRIVMSG"); m.Params[1] != "op" {
+		t.Errorf("PRIVMSG = %v, want op", m)
+	}
+
+	alice.send("MODE #x +v bob")
+	bob.expect("MODE")
+	bob.send("PRIVMSG #x :voiced")
+	if m := alice.expect("PRIVMSG"); m.Params[1] != "voiced" {
+		t.Errorf("PRIVMSG = %v, want voiced", m)
+	}
+}
@@ -9,22 +9,55 @@ import (
 	"strings"
 	"time"
 
+	"github.com/dgl/redisircd/ircbuf"
+
 	"gopkg.in/sorcix/irc.v2"
 )
 
-type CommandFn func(*Client, *irc.Message) error
+const (
+	// Maximum length of an AWAY message
+	awayLen = 200
+	// Maximum number of targets of a PRIVMSG, NOTICE or TAGMSG
+	maxTargets = 4
+)
+
+type CommandFn func(*Client, *ircbuf.Message) error
 
 type commandMap map[string]CommandFn
 
 var commands = commandMap{
-	"PING":    (*Client).ping,
-	"PONG":    (*Client).pong,
-	"JOIN":    (*Client).join,
-	"QUIT":    (*Client).userQuit,
-	"PART":    (*Client).part,
-	"PRIVMSG": (*Client).msg,
-	"NOTICE":  (*Client).msg,
-	"MODE":    (*Client).mode,
+	"PING":         (*Client).ping,
+	"PONG":         (*Client).pong,
+	"JOIN":         (*Client).join,
+	"QUIT":         (*Client).userQuit,
+	"PART":         (*Client).part,
+	"PRIVMSG":      (*Client).msg,
+	"NOTICE":       (*Client).msg,
+	"MODE":         (*Client).mode,
+	"NICK":         (*Client).changeNick,
+	"WHO":          (*Client).who,
+	"WHOIS":        (*Client).whois,
+	"WHOWAS":       (*Client).whowas,
+	"TOPIC":        (*Client).topic,
+	"NAMES":        (*Client).names,
+	"LIST":         (*Client).list,
+	"KICK":         (*Client).kick,
+	"INVITE":       (*Client).invite,
+	"CAP":          (*Client).cap,
+	"TAGMSG":       (*Client).tagmsg,
+	"AWAY":         (*Client).away,
+	"AUTHENTICATE": (*Client).authenticate,
+	"MOTD":         (*Client).motd,
+	"VERSION":      (*Client).version,
+	"TIME":         (*Client).time,
+	"INFO":         (*Client).info,
+	"ADMIN":        (*Client).admin,
+	"LUSERS":       (*Client).lusers,
+	"OPER":         (*Client).oper,
+	"KILL":         (*Client).kill,
+	"WALLOPS":      (*Client).wallops,
+	"REHASH":       (*Client).rehash,
+	"CHATHISTORY":  (*Client).chathistory,
 }
 
 // commands receives inbound commands from the client
@@ -32,15 +65,25 @@ func (c *Client) commands() error {
 	for {
 		c.tcpConn.SetReadDeadline(time.Now().Add(timeoutDuration))
 		message, err := c.Decode()
+		if err == ircbuf.ErrInvalidUTF8 {
+			c.active()
+			c.invalidUTF8(message)
+			continue
+		}
 		if err != nil {
+			select {
+			case reason := <-c.killed:
+				return c.quit(reason)
+			default:
+			}
 			if oerr, ok := err.(*net.OpError); ok {
 				if oerr.Timeout() {
 					// Timeout, maybe send a ping?
-					now := time.Now()
-					if c.last.Add(3 * timeoutDuration).After(now) {
+					idle := c.idle()
+					if idle < 3*timeoutDuration {
 						c.Encode(&irc.Message{Command: "PING", Params: []string{c.Server.Name}})
 					} else {
-						return c.quit(fmt.Sprintf("Ping timeout (%d seconds)", int(now.Sub(c.last)/time.Second)))
+						return c.quit(fmt.Sprintf("Ping timeout (%d seconds)", int(idle/time.Second)))
 					}
 					continue
 				} else {
@@ -58,11 +101,18 @@ func (c *Client) commands() error {
 		if message == nil {
 			continue
 		}
-		c.last = time.Now()
+		c.active()
 		if c.Server.Debug {
 			log.Print(message)
 		}
 
+		label := message.Tags["label"]
+		if len(label) > 0 && c.caps.has("labeled-response") {
+			c.labelBegin(label)
+		} else {
+			label = ""
+		}
+
 		if cmd, ok := commands[message.Command]; ok {
 			err := cmd(c, message)
 			if err != nil {
@@ -71,16 +121,20 @@ func (c *Client) commands() error {
 		} else {
 			c.reply(irc.ERR_UNKNOWNCOMMAND, "Unknown command")
 		}
+
+		if len(label) > 0 {
+			c.labelSync()
+		}
 	}
 }
 
-func (c *Client) ping(m *irc.Message) error {
+func (c *Client) ping(m *ircbuf.Message) error {
 	if len(m.Params) < 1 {
 		c.reply(irc.ERR_NEEDMOREPARAMS, "PING", "Not enough parameters")
 		return nil
 	}
 
-	c.Encode(&irc.Message{
+	c.send(&irc.Message{
 		Prefix:  &irc.Prefix{Name: c.Server.Name},
 		Command: "PONG",
 		Params:  []string{c.Server.Name, m.Params[0]}})
@@ -88,27 +142,36 @@ func (c *Client) ping(m *irc.Message) error {
 	return nil
 }
 
-func (c *Client) pong(m *irc.Message) error {
+func (c *Client) pong(m *ircbuf.Message) error {
 	return nil
 }
 
-func (c *Client) join(m *irc.Message) error {
+func (c *Client) join(m *ircbuf.Message) error {
 	if len(m.Params) < 1 {
 		c.reply(irc.ERR_NEEDMOREPARAMS, "JOIN", "Not enough parameters")
 		return nil
 	}
 
-	for _, ch := range strings.Split(m.Params[0], ",") {
+	var keys []string
+	if len(m.Params) > 1 {
+		keys = strings.Split(m.Params[1], ",")
+	}
+
+	for i, ch := range strings.Split(m.Params[0], ",") {
 		if !validChan(ch) {
 			c.reply("479" /* Not in RFC2812, but used by various IRCd */, ch, "Illegal channel name")
 			return nil
 		}
-		c.Server.cs.send(chanRequest{Name: ch, Type: CR_JOIN, User: c.User})
+		var params []string
+		if i < len(keys) {
+			params = []string{keys[i]}
+		}
+		c.Server.cs.send(chanRequest{Name: ch, Type: CR_JOIN, User: c.User, Params: params})
 	}
 	return nil
 }
 
-func (c *Client) msg(m *irc.Message) error {
+func (c *Client) msg(m *ircbuf.Message) error {
 	if len(m.Params) < 1 || len(m.Params[0]) < 1 {
 		c.reply(irc.ERR_NORECIPIENT, "No recipient given")
 		return nil
@@ -118,26 +181,107 @@ func (c *Client) msg(m *irc.Message) error {
 		return nil
 	}
 
-	target := m.Params[0]
-	text := m.Params[1]
-	if target[0] == '#' || target[0] == '$' {
-		t := CR_PRIVMSG
-		if m.Command == "NOTICE" {
-			t = CR_NOTICE
+	// The text, followed by the CTCP command and parameters if it is one. CTCP
+	// replies (in a NOTICE) are just passed on.
+	params := []string{m.Params[1]}
+	if cmd, ctcpParams, ok := parseCTCP(m.Params[1]); ok && m.Command == "PRIVMSG" {
+		params = append(params, cmd, ctcpParams)
+	}
+	for _, target := range c.targets(m.Params[0]) {
+		if target[0] == '#' || target[0] == '$' {
+			t := CR_PRIVMSG
+			if m.Command == "NOTICE" {
+				t = CR_NOTICE
+			}
+			c.Server.cs.send(chanRequest{Name: target, Type: t, User: c.User, Params: params, Tags: m.Tags.ClientOnly()})
+		} else {
+			t := NR_PRIVMSG
+			if m.Command == "NOTICE" {
+				t = NR_NOTICE
+			}
+			c.Server.ns.send(nickRequest{Name: target, Type: t, User: c.User, Params: params, Tags: m.Tags.ClientOnly()})
 		}
-		c.Server.cs.send(chanRequest{Name: target, Type: t, User: c.User, Params: []string{text}})
-	} else {
-		t := NR_PRIVMSG
-		if m.Command == "NOTICE" {
-			t = NR_NOTICE
+	}
+
+	return nil
+}
+
+// targets splits a comma separated list of message targets, ignoring
+// duplicates. If there are more than maxTargets it replies with
+// ERR_TOOMANYTARGETS and returns none.
+func (c *Client) targets(list string) []string {
+	var targets []string
+	seen := map[string]bool{}
+	for _, target := range strings.Split(list, ",") {
+		if len(target) == 0 || seen[strings.ToLower(target)] {
+			continue
 		}
-		c.Server.ns.send(nickRequest{Name: target, Type: t, User: c.User, Params: []string{text}})
+		seen[strings.ToLower(target)] = true
+		targets = append(targets, target)
+	}
+
+	if len(targets) > maxTargets {
+		c.reply(irc.ERR_TOOMANYTARGETS, list, fmt.Sprintf("Too many recipients, the limit is %d", maxTargets))
+		return nil
+	}
+	if len(targets) == 0 {
+		c.reply(irc.ERR_NORECIPIENT, "No recipient given")
 	}
+	return targets
+}
 
+func (c *Client) tagmsg(m *ircbuf.Message) error {
+	if len(m.Params) < 1 || len(m.Params[0]) < 1 {
+		c.reply(irc.ERR_NORECIPIENT, "No recipient given")
+		return nil
+	}
+
+	tags := m.Tags.ClientOnly()
+	for _, target := range c.targets(m.Params[0]) {
+		if target[0] == '#' || target[0] == '$' {
+			c.Server.cs.send(chanRequest{Name: target, Type: CR_TAGMSG, User: c.User, Tags: tags})
+		} else {
+			c.Server.ns.send(nickRequest{Name: target, Type: NR_TAGMSG, User: c.User, Tags: tags})
+		}
+	}
 	return nil
 }
 
-func (c *Client) part(m *irc.Message) error {
+func (c *Client) changeNick(m *ircbuf.Message) error {
+	if len(m.Params) < 1 || len(m.Params[0]) < 1 {
+		c.reply(irc.ERR_NONICKNAMEGIVEN, "No nickname given")
+		return nil
+	}
+
+	nick := m.Params[0]
+	if !validNick(nick) {
+		c.reply(irc.ERR_ERRONEUSNICKNAME, nick, "Erroneous nickname")
+		return nil
+	}
+	if nick == c.User.Nick {
+		return nil
+	}
+
+	oldPrefix := c.User.Prefix
+	req := nickRequest{
+		Type:  NR_CHANGE,
+		Name:  nick,
+		User:  c.User,
+		Reply: make(chan *User),
+	}
+	c.Server.ns.send(req)
+
+	if u := <-req.Reply; u == nil {
+		c.reply(irc.ERR_NICKNAMEINUSE, nick, "Nickname already in use")
+		return nil
+	}
+	c.nick = nick
+
+	c.Server.cs.send(chanRequest{Type: CR_NICK, User: c.User, Params: []string{oldPrefix.String(), nick}})
+	return nil
+}
+
+func (c *Client) part(m *ircbuf.Message) error {
 	if len(m.Params) < 1 {
 		c.reply(irc.ERR_NEEDMOREPARAMS, "PART", "Not enough parameters")
 		return nil
@@ -158,7 +302,78 @@ func (c *Client) part(m *irc.Message) error {
 	return nil
 }
 
-func (c *Client) userQuit(m *irc.Message) error {
+func (c *Client) topic(m *ircbuf.Message) error {
+	if len(m.Params) < 1 {
+		c.reply(irc.ERR_NEEDMOREPARAMS, "TOPIC", "Not enough parameters")
+		return nil
+	}
+
+	target := m.Params[0]
+	if !validChan(target) {
+		c.reply("479" /* Not in RFC2812, but used by various IRCd */, target, "Illegal channel name")
+		return nil
+	}
+
+	if len(m.Params) == 1 {
+		c.Server.cs.send(chanRequest{Type: CR_TOPIC, User: c.User, Name: target})
+	} else {
+		c.Server.cs.send(chanRequest{Type: CR_TOPIC, User: c.User, Name: target, Params: m.Params[1:2]})
+	}
+	return nil
+}
+
+func (c *Client) names(m *ircbuf.Message) error {
+	if len(m.Params) < 1 {
+		// Listing every channel isn't useful here.
+		c.reply(irc.RPL_ENDOFNAMES, "*", "End of NAMES list")
+		return nil
+	}
+
+	for _, ch := range strings.Split(m.Params[0], ",") {
+		c.Server.cs.send(chanRequest{Type: CR_NAMES, User: c.User, Name: ch})
+	}
+	return nil
+}
+
+func (c *Client) list(m *ircbuf.Message) error {
+	c.Server.cs.send(chanRequest{Type: CR_LIST, User: c.User, Params: m.Params})
+	return nil
+}
+
+func (c *Client) kick(m *ircbuf.Message) error {
+	if len(m.Params) < 2 {
+		c.reply(irc.ERR_NEEDMOREPARAMS, "KICK", "Not enough parameters")
+		return nil
+	}
+
+	c.Server.cs.send(chanRequest{Type: CR_KICK, User: c.User, Name: m.Params[0], Params: m.Params[1:]})
+	return nil
+}
+
+func (c *Client) invite(m *ircbuf.Message) error {
+	if len(m.Params) < 2 {
+		c.reply(irc.ERR_NEEDMOREPARAMS, "INVITE", "Not enough parameters")
+		return nil
+	}
+
+	nick, ch := m.Params[0], m.Params[1]
+	req := nickRequest{
+		Type:  NR_LOOKUP,
+		Name:  nick,
+		Reply: make(chan *User),
+	}
+	c.Server.ns.send(req)
+	target := <-req.Reply
+	if target == nil {
+		c.reply(irc.ERR_NOSUCHNICK, nick, "No such nick/channel")
+		return nil
+	}
+
+	c.Server.cs.send(chanRequest{Type: CR_INVITE, User: c.User, Target: target, Name: ch})
+	return nil
+}
+
+func (c *Client) userQuit(m *ircbuf.Message) error {
 	reason := ""
 	if len(m.Params) >= 1 {
 		reason = m.Params[0]
@@ -173,7 +388,7 @@ func (c *Client) userQuit(m *irc.Message) error {
 
 func (c *Client) quit(reason string) error {
 	c.Server.cs.send(chanRequest{Type: CR_QUIT, User: c.User, Params: []string{reason}})
-	c.Server.ns.send(nickRequest{Type: NR_QUIT, Name: c.User.Nick})
+	c.Server.ns.send(nickRequest{Type: NR_QUIT, Name: c.User.Nick, User: c.User})
 	c.Encode(&irc.Message{
 		Prefix:  c.User.Prefix,
 		Command: "QUIT",
@@ -181,7 +396,7 @@ func (c *Client) quit(reason string) error {
 	return errors.New(reason)
 }
 
-func (c *Client) mode(m *irc.Message) error {
+func (c *Client) mode(m *ircbuf.Message) error {
 	if len(m.Params) < 1 {
 		c.reply(irc.ERR_NEEDMOREPARAMS, "MODE", "Not enough parameters")
 		return nil
@@ -199,11 +414,7 @@ func (c *Client) mode(m *irc.Message) error {
 	} else {
 		// User
 		if strings.ToLower(target) == strings.ToLower(c.User.Nick) {
-			if len(m.Params) == 1 {
-				c.reply(irc.RPL_UMODEIS, "+i")
-			} else {
-				// No changing of umode yet.
-			}
+			c.Server.ns.send(nickRequest{Type: NR_UMODE, User: c.User, Params: m.Params[1:]})
 		} else {
 			c.reply(irc.ERR_USERSDONTMATCH, "Can't change mode for other users")
 		}
@@ -211,3 +422,61 @@ func (c *Client) mode(m *irc.Message) error {
 
 	return nil
 }
+
+func (c *Client) who(m *ircbuf.Message) error {
+	mask := ""
+	if len(m.Params) >= 1 {
+		mask = m.Params[0]
+	}
+
+	if len(mask) > 0 && (mask[0] == '#' || mask[0] == '$') {
+		c.Server.cs.send(chanRequest{Type: CR_WHO, User: c.User, Name: mask})
+	} else {
+		c.Server.ns.send(nickRequest{Type: NR_WHO, User: c.User, Name: mask})
+	}
+	return nil
+}
+
+func (c *Client) whois(m *ircbuf.Message) error {
+	if len(m.Params) < 1 {
+		c.reply(irc.ERR_NONICKNAMEGIVEN, "No nickname given")
+		return nil
+	}
+
+	// WHOIS [server] nick, we only have one server.
+	nicks := m.Params[len(m.Params)-1]
+	for _, nick := range strings.Split(nicks, ",") {
+		req := nickRequest{
+			Type:  NR_LOOKUP,
+			Name:  nick,
+			Reply: make(chan *User),
+		}
+		c.Server.ns.send(req)
+		target := <-req.Reply
+		c.Server.cs.send(chanRequest{Type: CR_WHOIS, User: c.User, Target: target, Name: nick})
+	}
+	return nil
+}
+
+func (c *Client) whowas(m *ircbuf.Message) error {
+	if len(m.Params) < 1 {
+		c.reply(irc.ERR_NONICKNAMEGIVEN, "No nickname given")
+		return nil
+	}
+
+	for _, nick := range strings.Split(m.Params[0], ",") {
+		c.Server.ns.send(nickRequest{Type: NR_WHOWAS, User: c.User, Name: nick, Params: m.Params[1:]})
+	}
+	return nil
+}
+
+func (c *Client) away(m *ircbuf.Message) error {
+	message := ""
+	if len(m.Params) > 0 {
+		message = m.Params[0]
+	}
+	message = truncateUTF8(message, awayLen)
+
+	c.Server.ns.send(nickRequest{Type: NR_AWAY, User: c.User, Params: []string{message}})
+	return nil
+}
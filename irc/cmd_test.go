@@ -0,0 +1,47 @@
+package irc
+
+import "testing"
+
+func TestMessageTargets(t *testing.T) {
+	_, addr := newTestServer(t)
+	alice := register(t, addr, "alice")
+	bob := register(t, addr, "bob")
+	carol := register(t, addr, "carol")
+	joinTest(t, alice, bob)
+
+	// Duplicates (in any case) only get one copy.
+	alice.send("PRIVMSG bob,#x,carol,BOB :hi")
+	// Channel and private messages take different paths, so each gets an end.
+	alice.send("PRIVMSG bob,#x :end")
+	got := map[string]int{}
+	for ends := 0; ends < 2; {
+		m := bob.expect("PRIVMSG")
+		if m.Params[1] == "end" {
+			ends++
+			continue
+		}
+		got[m.Params[0]]++
+	}
+	if got["bob"] != 1 || got["#x"] != 1 || len(got) != 2 {
+		t.Errorf("bob got %v, want one each to bob and #x", got)
+	}
+	if m := carol.expect("PRIVMSG"); m.Params[0] != "carol" || m.Params[1] != "hi" {
+		t.Errorf("carol got %v, want hi", m)
+	}
+
+	alice.send("PRIVMSG a,b,c,d,e :hi")
+	if m := alice.read(); m.Command != "407" {
+		t.Errorf("too many targets = %v, want ERR_TOOMANYTARGETS", m)
+	}
+	alice.send("PRIVMSG , :hi")
+	if m := alice.read(); m.Command != "411" {
+		t.Errorf("no targets = %v, want ERR_NORECIPIENT", m)
+	}
+	alice.send("PRIVMSG nobody,bob :hi")
+	if m := alice.expect("401"); m.Params[1] != "nobody" {
+		t.Errorf("unknown target = %v, want ERR_NOSUCHNICK nobody", m)
+	}
+	if m := bob.expect("PRIVMSG"); m.Params[1] != "hi" {
+		t.Errorf("bob got %v, want hi", m)
+	}
+}
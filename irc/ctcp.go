@@ -0,0 +1,74 @@
+package irc
+
+import (
+	"strings"
+	"time"
+
+	"github.com/dgl/redisircd/ircbuf"
+
+	"gopkg.in/sorcix/irc.v2"
+)
+
+const ctcpDelim = "\x01"
+
+// parseCTCP splits a CTCP message, e.g. "\x01ACTION waves\x01", into its
+// command and parameters. The final delimiter is optional, as some clients
+// leave it off.
+func parseCTCP(text string) (cmd, params string, ok bool) {
+	if len(text) < 2 || !strings.HasPrefix(text, ctcpDelim) {
+		return "", "", false
+	}
+	text = strings.TrimSuffix(text[1:], ctcpDelim)
+	if i := strings.IndexByte(text, ' '); i >= 0 {
+		cmd, params = text[:i], text[i+1:]
+	} else {
+		cmd = text
+	}
+	if len(cmd) == 0 {
+		return "", "", false
+	}
+	return strings.ToUpper(cmd), params, true
+}
+
+// ctcp answers a CTCP request sent to a nick that isn't connected, on behalf
+// of the Redis virtual user with that nick if there is one. params are the
+// original text, the CTCP command and its parameters.
+func (cs *chanServer) ctcp(user *User, nick string, params []string, tags ircbuf.Tags) {
+	server := cs.server
+	var virtual *irc.Prefix
+	for _, ch := range cs.channels {
+		if _, ok := ch.redisNicks[strings.ToLower(nick)]; ok {
+			virtual = &irc.Prefix{Name: nick, User: "auto", Host: "redis"}
+			break
+		}
+	}
+	if virtual == nil {
+		cs.reply(user, irc.ERR_NOSUCHNICK, nick, "No such nick/channel")
+		return
+	}
+
+	if user.hasCap("echo-message") {
+		cs.sendTagsTo(user, messageTags(tags, time.Now()), &irc.Message{
+			Prefix:  user.Prefix,
+			Command: "PRIVMSG",
+			Params:  []string{nick, params[0]}})
+	}
+
+	reply := params[1]
+	switch params[1] {
+	case "VERSION":
+		reply += " " + server.version() + " (Redis pubsub virtual user)"
+	case "PING":
+		if len(params[2]) > 0 {
+			reply += " " + params[2]
+		}
+	case "TIME":
+		reply += " " + time.Now().Format(time.RFC1123)
+	default:
+		return
+	}
+	cs.sendTo(user, &irc.Message{
+		Prefix:  virtual,
+		Command: "NOTICE",
+		Params:  []string{user.Nick, ctcpDelim + reply + ctcpDelim}})
+}
@@ -0,0 +1,30 @@
+package irc
+
+import "testing"
+
+func TestParseCTCP(t *testing.T) {
+	tests := []struct {
+		text, cmd, params string
+		ok                bool
+	}{
+		{"\x01ACTION waves\x01", "ACTION", "waves", true},
+		{"\x01action waves\x01", "ACTION", "waves", true},
+		{"\x01ACTION waves", "ACTION", "waves", true},
+		{"\x01VERSION\x01", "VERSION", "", true},
+		{"\x01PING 123 456\x01", "PING", "123 456", true},
+		{"\x01ACTION \x01", "ACTION", "", true},
+		{"\x01\x01", "", "", false},
+		{"\x01 waves\x01", "", "", false},
+		{"\x01", "", "", false},
+		{"", "", "", false},
+		{"hello", "", "", false},
+		{"hi \x01ACTION waves\x01", "", "", false},
+	}
+	for _, tt := range tests {
+		cmd, params, ok := parseCTCP(tt.text)
+		if cmd != tt.cmd || params != tt.params || ok != tt.ok {
+			t.Errorf("parseCTCP(%q) = %q, %q, %v, want %q, %q, %v",
+				tt.text, cmd, params, ok, tt.cmd, tt.params, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package irc
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// Encodings Redis payloads that aren't UTF-8 can be decoded from (+E)
+var legacyEncodings = map[string]bool{
+	"latin1": true,
+	"cp1252": true,
+}
+
+// cp1252 is where CP1252 differs from Latin-1, 0x80 to 0x9f. The bytes CP1252
+// leaves undefined are the same control characters as Latin-1.
+var cp1252 = [32]rune{
+	0x20ac, 0x0081, 0x201a, 0x0192, 0x201e, 0x2026, 0x2020, 0x2021,
+	0x02c6, 0x2030, 0x0160, 0x2039, 0x0152, 0x008d, 0x017d, 0x008f,
+	0x0090, 0x2018, 0x2019, 0x201c, 0x201d, 0x2022, 0x2013, 0x2014,
+	0x02dc, 0x2122, 0x0161, 0x203a, 0x0153, 0x009d, 0x017e, 0x0178,
+}
+
+// toUTF8 returns b as UTF-8. If it isn't already it is decoded from the
+// fallback encoding, or without one invalid bytes are replaced with U+FFFD.
+func toUTF8(b []byte, fallback string) string {
+	if utf8.Valid(b) {
+		return string(b)
+	}
+
+	switch fallback {
+	case "latin1", "cp1252":
+		var s strings.Builder
+		for _, c := range b {
+			if fallback == "cp1252" && c >= 0x80 && c <= 0x9f {
+				s.WriteRune(cp1252[c-0x80])
+			} else {
+				s.WriteRune(rune(c))
+			}
+		}
+		return s.String()
+	}
+	return strings.ToValidUTF8(string(b), "\uFFFD")
+}
+
+// truncateUTF8 cuts s to at most n bytes, without cutting a UTF-8 sequence in
+// half.
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	i := n
+	for i > 0 && !utf8.RuneStart(s[i]) {
+		i--
+	}
+	return s[:i]
+}
@@ -0,0 +1,51 @@
+package irc
+
+import "testing"
+
+func TestToUTF8(t *testing.T) {
+	tests := []struct {
+		b        string
+		fallback string
+		want     string
+	}{
+		{"héllo", "", "héllo"},
+		{"héllo", "latin1", "héllo"},
+		{"h\xe9llo", "", "h\uFFFDllo"},
+		{"h\xe9llo", "latin1", "héllo"},
+		{"h\xe9llo", "cp1252", "héllo"},
+		{"\x80 \x99", "latin1", "\u0080 \u0099"},
+		{"\x80 \x99", "cp1252", "€ ™"},
+		{"\x81\x9d", "cp1252", "\u0081\u009d"},
+		{"\xff\xfe", "", "\uFFFD"},
+		{"", "", ""},
+	}
+	for _, tt := range tests {
+		if got := toUTF8([]byte(tt.b), tt.fallback); got != tt.want {
+			t.Errorf("toUTF8(%q, %q) = %q, want %q", tt.b, tt.fallback, got, tt.want)
+		}
+	}
+}
+
+func TestTruncateUTF8(t *testing.T) {
+	tests := []struct {
+		s    string
+		n    int
+		want string
+	}{
+		{"hello", 10, "hello"},
+		{"hello", 5, "hello"},
+		{"hello", 3, "hel"},
+		{"héllo", 2, "h"},
+		{"héllo", 3, "hé"},
+		{"€", 2, ""},
+		{"a€", 3, "a"},
+		{"hello", 0, ""},
+		{"", 3, ""},
+		{"\xa9\xa9\xa9", 2, ""},
+	}
+	for _, tt := range tests {
+		if got := truncateUTF8(tt.s, tt.n); got != tt.want {
+			t.Errorf("truncateUTF8(%q, %d) = %q, want %q", tt.s, tt.n, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,317 @@
+package irc
+
+import (
+	"context"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgl/redisircd/ircbuf"
+
+	"github.com/mediocregopher/radix/v4"
+	"gopkg.in/sorcix/irc.v2"
+)
+
+const (
+	// Maximum number of messages returned by a single CHATHISTORY request
+	historyMaxLimit = 100
+)
+
+// history stores channel messages in a Redis stream per channel, so they
+// survive restarts and can be shared between instances.
+//
+// Stream IDs are the time of the message as given to clients (which may be
+// from a +S JSON payload), so timestamps used with CHATHISTORY match it. IDs
+// must increase, so a message with an earlier time than the last one stored is
+// stored just after it.
+type history struct {
+	server *Server
+	// Last ID added to each stream, only used by the Redis queue
+	lastID map[string]radix.StreamEntryID
+
+	// Connections for queries, created on first use
+	poolMu sync.Mutex
+	pool   radix.Client
+}
+
+// add queues a message to be written to the channel's stream.
+func (h *history) add(channel string, tags ircbuf.Tags, msg *irc.Message) {
+	if len(h.server.HistoryKey) == 0 {
+		return
+	}
+
+	text := ""
+	if len(msg.Params) > 1 {
+		text = msg.Params[1]
+	}
+	wireTags := ""
+	if b := tags.Bytes(); len(b) > 0 {
+		wireTags = string(b[1:])
+	}
+	t, err := time.Parse(serverTimeFormat, tags["time"])
+	if err != nil {
+		t = time.Now()
+	}
+
+	key := h.key(channel)
+	h.server.redis.do(radix.WithConn(key, func(ctx context.Context, conn radix.Conn) error {
+		id, err := h.nextID(ctx, conn, key, t)
+		if err != nil {
+			return err
+		}
+		err = conn.Do(ctx, radix.Cmd(nil, "XADD", key,
+			"MAXLEN", "~", strconv.Itoa(h.server.HistoryLength), id.String(),
+			"msgid", tags["msgid"],
+			"tags", wireTags,
+			"prefix", msg.Prefix.String(),
+			"command", msg.Command,
+			"text", text))
+		if err != nil {
+			// Something else may have added to the stream, look again next time.
+			delete(h.lastID, key)
+			return err
+		}
+		h.lastID[key] = id
+		return nil
+	}))
+}
+
+// nextID returns the stream ID for a message sent at t, after the last one in
+// the stream.
+func (h *history) nextID(ctx context.Context, conn radix.Conn, key string, t time.Time) (radix.StreamEntryID, error) {
+	last, ok := h.lastID[key]
+	if !ok {
+		var entries []radix.StreamEntry
+		err := conn.Do(ctx, radix.Cmd(&entries, "XREVRANGE", key, "+", "-", "COUNT", "1"))
+		if err != nil {
+			return radix.StreamEntryID{}, err
+		}
+		if len(entries) > 0 {
+			last = entries[0].ID
+		}
+	}
+
+	id := radix.StreamEntryID{Time: uint64(t.UnixNano() / int64(time.Millisecond))}
+	if !last.Before(id) {
+		id = last.Next()
+	}
+	return id, nil
+}
+
+func (h *history) key(channel string) string {
+	return h.server.HistoryKey + strings.ToLower(channel)
+}
+
+// historyRef is a point in a channel's history, as a range of stream IDs as
+// a timestamp covers all the messages stored within that millisecond.
+type historyRef struct {
+	first, last radix.StreamEntryID
+	msgid       string
+}
+
+// parseHistoryRef parses a CHATHISTORY reference, msgid references still need
+// to be resolved against the stream.
+func parseHistoryRef(ref string) (historyRef, bool) {
+	kv := strings.SplitN(ref, "=", 2)
+	if len(kv) != 2 || len(kv[1]) == 0 {
+		return historyRef{}, false
+	}
+
+	switch kv[0] {
+	case "timestamp":
+		t, err := time.Parse(time.RFC3339Nano, kv[1])
+		if err != nil || t.Before(time.Unix(0, 0)) {
+			return historyRef{}, false
+		}
+		ms := uint64(t.UnixNano() / int64(time.Millisecond))
+		return historyRef{
+			first: radix.StreamEntryID{Time: ms},
+			last:  radix.StreamEntryID{Time: ms, Seq: math.MaxUint64},
+		}, true
+	case "msgid":
+		return historyRef{msgid: kv[1]}, true
+	}
+	return historyRef{}, false
+}
+
+// chathistory handles the CHATHISTORY command, once the channel server has
+// checked the user can see the channel.
+func (c *Client) chathistory(m *ircbuf.Message) error {
+	if len(m.Params) < 4 {
+		c.fail("CHATHISTORY", "NEED_MORE_PARAMS", "Not enough parameters")
+		return nil
+	}
+
+	sub, target := strings.ToUpper(m.Params[0]), m.Params[1]
+	switch sub {
+	case "BEFORE", "AFTER", "LATEST", "AROUND":
+	default:
+		c.fail("CHATHISTORY", "UNKNOWN_COMMAND", sub, "Unknown subcommand")
+		return nil
+	}
+
+	if len(c.Server.HistoryKey) == 0 || !validChan(target) {
+		c.fail("CHATHISTORY", "INVALID_TARGET", sub, target, "Messages could not be retrieved")
+		return nil
+	}
+	if _, ok := parseHistoryRef(m.Params[2]); !ok && !(sub == "LATEST" && m.Params[2] == "*") {
+		c.fail("CHATHISTORY", "INVALID_PARAMS", sub, m.Params[2], "Invalid message reference")
+		return nil
+	}
+	if limit, err := strconv.Atoi(m.Params[3]); err != nil || limit < 1 || limit > historyMaxLimit {
+		c.fail("CHATHISTORY", "INVALID_PARAMS", sub, m.Params[3], "Invalid limit")
+		return nil
+	}
+
+	req := chanRequest{Type: CR_HISTORY, User: c.User, Name: target, Reply: make(chan bool)}
+	c.Server.cs.send(req)
+	if !<-req.Reply {
+		c.fail("CHATHISTORY", "INVALID_TARGET", sub, target, "Messages could not be retrieved")
+		return nil
+	}
+
+	c.Server.history.query(c, target, []string{sub, m.Params[2], m.Params[3]})
+	return nil
+}
+
+// query sends the requested history to the client, the parameters have already
+// been validated by Client.chathistory.
+func (h *history) query(c *Client, channel string, params []string) {
+	sub := params[0]
+	limit, _ := strconv.Atoi(params[2])
+	fail := func() {
+		c.fail("CHATHISTORY", "MESSAGE_ERROR", sub, channel, "Messages could not be retrieved")
+	}
+
+	conn, err := h.conn()
+	if err != nil {
+		log.Printf("Failed dial: %v", err)
+		fail()
+		return
+	}
+
+	key := h.key(channel)
+	var entries []radix.StreamEntry
+	ref, ok := parseHistoryRef(params[1])
+	if ok && len(ref.msgid) > 0 {
+		ok, err = h.resolve(conn, key, &ref)
+		if err != nil {
+			log.Printf("Failed to find %q in history for %v: %v", ref.msgid, channel, err)
+			fail()
+			return
+		}
+	}
+
+	switch {
+	case sub == "LATEST" && params[1] == "*":
+		entries, err = h.rev(conn, key, "+", "-", limit)
+	case !ok:
+		// An unknown msgid, which has probably been trimmed, just send an
+		// empty batch.
+	case sub == "LATEST":
+		entries, err = h.rev(conn, key, "+", ref.last.Next().String(), limit)
+	case sub == "BEFORE":
+		if ref.first != (radix.StreamEntryID{}) {
+			entries, err = h.rev(conn, key, ref.first.Prev().String(), "-", limit)
+		}
+	case sub == "AFTER":
+		err = conn.Do(context.TODO(), radix.Cmd(&entries, "XRANGE", key,
+			ref.last.Next().String(), "+", "COUNT", strconv.Itoa(limit)))
+	case sub == "AROUND":
+		entries, err = h.rev(conn, key, ref.last.String(), "-", (limit+1)/2)
+		if err == nil && len(entries) < limit {
+			var after []radix.StreamEntry
+			err = conn.Do(context.TODO(), radix.Cmd(&after, "XRANGE", key,
+				ref.last.Next().String(), "+", "COUNT", strconv.Itoa(limit-len(entries))))
+			entries = append(entries, after...)
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to get history for %v: %v", channel, err)
+		fail()
+		return
+	}
+
+	batch := ""
+	if c.User.hasCap("batch") {
+		batch = newMsgID()
+		c.send(&irc.Message{
+			Prefix:  &irc.Prefix{Name: h.server.Name},
+			Command: "BATCH",
+			Params:  []string{"+" + batch, "chathistory", channel}})
+	}
+	for _, e := range entries {
+		f := map[string]string{}
+		for _, kv := range e.Fields {
+			f[kv[0]] = kv[1]
+		}
+		tags := ircbuf.ParseTags(f["tags"])
+		if len(batch) > 0 {
+			tags["batch"] = batch
+		}
+		c.sendTags(tags, &irc.Message{
+			Prefix:  irc.ParsePrefix(f["prefix"]),
+			Command: f["command"],
+			Params:  []string{channel, f["text"]}})
+	}
+	if len(batch) > 0 {
+		c.send(&irc.Message{
+			Prefix:  &irc.Prefix{Name: h.server.Name},
+			Command: "BATCH",
+			Params:  []string{"-" + batch}})
+	}
+}
+
+// conn returns the pool used for queries, creating it if needed.
+func (h *history) conn() (radix.Client, error) {
+	h.poolMu.Lock()
+	defer h.poolMu.Unlock()
+	if h.pool == nil {
+		pool, err := radix.PoolConfig{}.New(context.TODO(), "tcp", h.server.RedisHost)
+		if err != nil {
+			return nil, err
+		}
+		h.pool = pool
+	}
+	return h.pool, nil
+}
+
+// rev returns up to count entries from end back to start, in the order they
+// were added.
+func (h *history) rev(conn radix.Client, key, end, start string, count int) ([]radix.StreamEntry, error) {
+	var entries []radix.StreamEntry
+	err := conn.Do(context.TODO(), radix.Cmd(&entries, "XREVRANGE", key, end, start, "COUNT", strconv.Itoa(count)))
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries, err
+}
+
+// resolve finds the stream ID of a msgid reference, searching back from the
+// most recent message. Returns false if it isn't in the stream.
+func (h *history) resolve(conn radix.Client, key string, ref *historyRef) (bool, error) {
+	end := "+"
+	for searched := 0; searched < h.server.HistoryLength; searched += historyMaxLimit {
+		var entries []radix.StreamEntry
+		err := conn.Do(context.TODO(), radix.Cmd(&entries, "XREVRANGE", key, end, "-", "COUNT", strconv.Itoa(historyMaxLimit)))
+		if err != nil {
+			return false, err
+		}
+		for _, e := range entries {
+			for _, kv := range e.Fields {
+				if kv[0] == "msgid" && kv[1] == ref.msgid {
+					ref.first, ref.last = e.ID, e.ID
+					return true, nil
+				}
+			}
+		}
+		if len(entries) < historyMaxLimit {
+			break
+		}
+		end = entries[len(entries)-1].ID.Prev().String()
+	}
+	return false, nil
+}
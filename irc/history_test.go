@@ -0,0 +1,40 @@
+package irc
+
+import (
+	"math"
+	"testing"
+
+	"github.com/mediocregopher/radix/v4"
+)
+
+func TestParseHistoryRef(t *testing.T) {
+	tests := []struct {
+		ref  string
+		want historyRef
+		ok   bool
+	}{
+		{"msgid=abc", historyRef{msgid: "abc"}, true},
+		{"msgid=a=b", historyRef{msgid: "a=b"}, true},
+		{"timestamp=2023-11-14T22:13:20.123Z", historyRef{
+			first: radix.StreamEntryID{Time: 1700000000123},
+			last:  radix.StreamEntryID{Time: 1700000000123, Seq: math.MaxUint64},
+		}, true},
+		{"timestamp=2023-11-14T23:13:20+01:00", historyRef{
+			first: radix.StreamEntryID{Time: 1700000000000},
+			last:  radix.StreamEntryID{Time: 1700000000000, Seq: math.MaxUint64},
+		}, true},
+		{"timestamp=1969-12-31T23:59:59Z", historyRef{}, false},
+		{"timestamp=yesterday", historyRef{}, false},
+		{"msgid=", historyRef{}, false},
+		{"msgid", historyRef{}, false},
+		{"*", historyRef{}, false},
+		{"id=abc", historyRef{}, false},
+		{"", historyRef{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseHistoryRef(tt.ref)
+		if ok != tt.ok || got != tt.want {
+			t.Errorf("parseHistoryRef(%q) = %+v, %v, want %+v, %v", tt.ref, got, ok, tt.want, tt.ok)
+		}
+	}
+}
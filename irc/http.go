@@ -3,12 +3,11 @@ package irc
 import (
 	"errors"
 
-	"gopkg.in/sorcix/irc.v2"
-
 	"github.com/dgl/redisircd/http"
+	"github.com/dgl/redisircd/ircbuf"
 )
 
-func (c *Client) maybeHTTP(m *irc.Message) error {
+func (c *Client) maybeHTTP(m *ircbuf.Message) error {
 	// Well, this is easier than using cmux? Maybe.
 
 	if len(m.Params) > 0 {
@@ -0,0 +1,164 @@
+package irc
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgl/redisircd/ircbuf"
+
+	"github.com/mediocregopher/radix/v4"
+	"gopkg.in/sorcix/irc.v2"
+)
+
+const (
+	// How long to wait for the MOTD from Redis, without it there's no MOTD
+	motdTimeout = 2 * time.Second
+)
+
+// version is the version string as shown to clients.
+func (s *Server) version() string {
+	debug := ""
+	if s.Debug {
+		debug = "[DEBUG]"
+	}
+	return fmt.Sprintf("%s-%s%s", NAME, VERSION, debug)
+}
+
+// readMOTD returns the MOTD, read every time so changes to the file or Redis
+// key are picked up without a restart.
+func (s *Server) readMOTD() (string, error) {
+	if len(s.MOTDKey) > 0 {
+		// Sent on connect, so don't hold up clients if Redis is slow.
+		ctx, cancel := context.WithTimeout(context.Background(), motdTimeout)
+		defer cancel()
+		var motd string
+		if err := s.redis.doWait(ctx, radix.Cmd(&motd, "GET", s.MOTDKey)); err != nil {
+			// motd may still be written after a timeout.
+			return "", err
+		}
+		return motd, nil
+	}
+	if len(s.MOTDFile) > 0 {
+		motd, err := os.ReadFile(s.MOTDFile)
+		return string(motd), err
+	}
+	return "", nil
+}
+
+// otherServer replies with ERR_NOSUCHSERVER if the optional server parameter
+// of a command isn't this server, as there are no others.
+func (c *Client) otherServer(m *ircbuf.Message) bool {
+	if len(m.Params) > 0 && !strings.EqualFold(m.Params[0], c.Server.Name) {
+		c.reply(irc.ERR_NOSUCHSERVER, m.Params[0], "No such server")
+		return true
+	}
+	return false
+}
+
+func (c *Client) motd(m *ircbuf.Message) error {
+	if !c.otherServer(m) {
+		c.sendMOTD()
+	}
+	return nil
+}
+
+func (c *Client) sendMOTD() {
+	motd, err := c.Server.readMOTD()
+	if err != nil {
+		log.Printf("Failed to read MOTD: %v", err)
+	}
+	motd = strings.TrimRight(motd, "\r\n")
+	if len(motd) == 0 {
+		c.reply(irc.ERR_NOMOTD, "MOTD File is missing")
+		return
+	}
+
+	c.reply(irc.RPL_MOTDSTART, fmt.Sprintf("- %s Message of the day - ", c.Server.Name))
+	for _, line := range strings.Split(motd, "\n") {
+		c.reply(irc.RPL_MOTD, "- "+strings.TrimRight(line, "\r"))
+	}
+	c.reply(irc.RPL_ENDOFMOTD, "End of MOTD command")
+}
+
+func (c *Client) version(m *ircbuf.Message) error {
+	if c.otherServer(m) {
+		return nil
+	}
+
+	c.reply(irc.RPL_VERSION, c.Server.version()+".", c.Server.Name, "https://github.com/dgl/redisircd")
+	c.isupport()
+	return nil
+}
+
+func (c *Client) time(m *ircbuf.Message) error {
+	if c.otherServer(m) {
+		return nil
+	}
+
+	c.reply(irc.RPL_TIME, c.Server.Name, time.Now().Format(time.RFC1123))
+	return nil
+}
+
+func (c *Client) info(m *ircbuf.Message) error {
+	if c.otherServer(m) {
+		return nil
+	}
+
+	for _, line := range []string{
+		c.Server.version(),
+		"An IRC server for Redis pubsub",
+		"https://github.com/dgl/redisircd",
+		"",
+		"Started " + c.Server.started.Format(time.RFC1123),
+	} {
+		c.reply(irc.RPL_INFO, line)
+	}
+	c.reply(irc.RPL_ENDOFINFO, "End of INFO list")
+	return nil
+}
+
+func (c *Client) admin(m *ircbuf.Message) error {
+	if c.otherServer(m) {
+		return nil
+	}
+
+	if len(c.Server.Admin) == 0 {
+		c.reply(irc.ERR_NOADMININFO, c.Server.Name, "No administrative info available")
+		return nil
+	}
+	c.reply(irc.RPL_ADMINME, c.Server.Name, "Administrative info")
+	c.reply(irc.RPL_ADMINLOC1, "Running "+c.Server.version())
+	c.reply(irc.RPL_ADMINEMAIL, c.Server.Admin)
+	return nil
+}
+
+func (c *Client) lusers(m *ircbuf.Message) error {
+	c.sendLusers()
+	return nil
+}
+
+// sendLusers gets the number of users from the nick server, then the channel
+// server replies with that and the rest. Waits for the reply, so anything sent
+// after is in order.
+func (c *Client) sendLusers() {
+	nreq := nickRequest{Type: NR_LUSERS, Count: make(chan int)}
+	c.Server.ns.send(nreq)
+	users, invisible := <-nreq.Count, <-nreq.Count
+
+	creq := chanRequest{Type: CR_LUSERS, User: c.User, Params: []string{fmt.Sprint(users), fmt.Sprint(invisible)}, Reply: make(chan bool)}
+	c.Server.cs.send(creq)
+	<-creq.Reply
+}
+
+func (cs *chanServer) lusers(user *User, users, invisible int) {
+	server := cs.server
+	cs.reply(user, irc.RPL_LUSERCLIENT, fmt.Sprintf("There are %d users and %d invisible on 1 servers", users, invisible))
+	cs.reply(user, irc.RPL_LUSERCHANNELS, fmt.Sprint(len(cs.channels)), "channels formed")
+	cs.reply(user, irc.RPL_LUSERME, fmt.Sprintf("I have %d clients, 0 servers and %d Redis subscriptions",
+		users+invisible, atomic.LoadInt32(&server.redisSubs)))
+}
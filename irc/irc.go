@@ -3,10 +3,14 @@ package irc
 import (
 	"log"
 	"net"
+	"sync"
+	"sync/atomic"
+	"text/template"
 	"time"
 
 	"github.com/dgl/redisircd/ircbuf"
 
+	"github.com/mediocregopher/radix/v4"
 	"gopkg.in/sorcix/irc.v2"
 )
 
@@ -15,13 +19,49 @@ const (
 	VERSION = "0.0.1"
 )
 
+const (
+	// Maximum length of an IRC line, not including the CR LF
+	maxLineLength = 510
+)
+
 type Server struct {
 	Name      string
 	RedisHost string
 	Debug     bool
 
-	cs *chanServer
-	ns *nickServer
+	// Redis hash of account names to bcrypt password hashes, for SASL
+	AccountsKey string
+	// Prefix of the Redis streams channel history is kept in, empty to disable
+	HistoryKey string
+	// Approximate number of messages kept per channel
+	HistoryLength int
+	// Prefix of the Redis hash of nicks to away messages, see awayKey
+	AwayKey string
+	// MOTD is read from the Redis key if set, otherwise the file
+	MOTDFile, MOTDKey string
+	// Contact details for ADMIN
+	Admin string
+	// File of operator names and bcrypt hashes, reloaded by REHASH
+	OperFile string
+	// Reject anything from clients that isn't UTF-8
+	UTF8Only bool
+	// File of named templates for +F, reloaded by REHASH
+	TemplateFile string
+
+	started time.Time
+	// Number of Redis pubsub channels currently subscribed to, atomic
+	redisSubs int32
+
+	opersMu sync.RWMutex
+	opers   map[string]string
+
+	templatesMu sync.RWMutex
+	templates   *template.Template
+
+	cs      *chanServer
+	ns      *nickServer
+	history *history
+	redis   *redisQueue
 }
 
 type Client struct {
@@ -31,11 +71,26 @@ type Client struct {
 
 	connected      bool
 	username, nick string
-	last           time.Time
+	signon         time.Time
+	// When the client last sent anything, in Unix nanoseconds, atomic as
+	// WHOIS reads it from the channel server
+	last int64
 
 	User *User
+	// Label of the labeled command being handled, see label.go
+	label string
 
 	Realname string
+
+	caps           capSet
+	capNegotiating bool
+	capVersion     int
+
+	account           string
+	saslMech, saslBuf string
+
+	// Reason if an operator used KILL
+	killed chan string
 }
 
 func NewServer(name, redisHost string, debug bool) *Server {
@@ -43,18 +98,32 @@ func NewServer(name, redisHost string, debug bool) *Server {
 		Name:      name,
 		RedisHost: redisHost,
 		Debug:     debug,
+		started:   time.Now(),
 	}
 	s.cs = NewChanServer(s)
 	s.ns = NewNickServer(s)
+	s.redis = newRedisQueue(s)
+	s.history = &history{server: s, lastID: make(map[string]radix.StreamEntryID)}
 	return s
 }
 
+// awayKey is the Redis hash of away messages, each server has its own so
+// clearing it on start doesn't affect others sharing the Redis.
+func (s *Server) awayKey() string {
+	return s.AwayKey + ":" + s.Name
+}
+
 func (s *Server) Listen(listen string) error {
 	ln, err := net.Listen("tcp", listen)
 	if err != nil {
 		return err
 	}
 
+	if len(s.AwayKey) > 0 {
+		// Anyone away before a restart isn't connected any more.
+		s.redis.do(radix.Cmd(nil, "DEL", s.awayKey()))
+	}
+
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
@@ -70,13 +139,30 @@ func (s *Server) Listen(listen string) error {
 	}
 }
 
+// host is the client's IP address, as used in its prefix
+func (c *Client) host() string {
+	return c.tcpConn.RemoteAddr().(*net.TCPAddr).IP.String()
+}
+
+// active records that the client has sent something.
+func (c *Client) active() {
+	atomic.StoreInt64(&c.last, time.Now().UnixNano())
+}
+
+// idle is how long since the client last sent anything.
+func (c *Client) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&c.last)))
+}
+
 func (s *Server) handle(conn net.Conn) {
 	defer conn.Close()
 	c := Client{
 		Server:  s,
 		Conn:    ircbuf.NewConn(conn),
 		tcpConn: conn,
+		killed:  make(chan string, 1),
 	}
+	c.UTF8Only = s.UTF8Only
 
 	err := c.pre()
 	if err != nil {
@@ -86,6 +172,9 @@ func (s *Server) handle(conn net.Conn) {
 	log.Printf("New connection %v", c.User.Prefix)
 
 	c.User.output()
+	c.connected = true
+	c.sendLusers()
+	c.sendMOTD()
 
 	err = c.commands()
 	if err != nil {
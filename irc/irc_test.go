@@ -0,0 +1,137 @@
+package irc
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgl/redisircd/ircbuf"
+)
+
+// newTestServer starts a server on a random port, with Redis unreachable.
+func newTestServer(t *testing.T) (*Server, string) {
+	t.Helper()
+	s := NewServer("test.server", "127.0.0.1:1", false)
+	return s, startTestServer(t, s)
+}
+
+// startTestServer listens on a random port for s, returning the address.
+func startTestServer(t *testing.T, s *Server) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.handle(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// testClient is a raw IRC connection to a test server.
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialTest(t *testing.T, addr string) *testClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+// register connects as nick, after requesting caps if any are given.
+func register(t *testing.T, addr, nick string, caps ...string) *testClient {
+	t.Helper()
+	tc := dialTest(t, addr)
+	if len(caps) > 0 {
+		tc.send("CAP LS 302")
+		tc.expect("CAP")
+		tc.send("CAP REQ :" + strings.Join(caps, " "))
+		if m := tc.expect("CAP"); m.Params[1] != "ACK" {
+			t.Fatalf("CAP REQ %v: %v", caps, m)
+		}
+	}
+	tc.send("NICK " + nick)
+	tc.send("USER " + nick + " 0 * :Test user")
+	if len(caps) > 0 {
+		tc.send("CAP END")
+	}
+	// The MOTD is last, there isn't one.
+	tc.expect("422")
+	return tc
+}
+
+func (tc *testClient) send(line string) {
+	tc.t.Helper()
+	if _, err := tc.conn.Write([]byte(line + "\r\n")); err != nil {
+		tc.t.Fatal(err)
+	}
+}
+
+// read returns the next message, failing if there isn't one soon.
+func (tc *testClient) read() *ircbuf.Message {
+	tc.t.Helper()
+	tc.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	line, err := tc.r.ReadString('\n')
+	if err != nil {
+		tc.t.Fatalf("read: %v", err)
+	}
+	m := ircbuf.ParseMessage(strings.TrimRight(line, "\r\n"))
+	if m == nil {
+		tc.t.Fatalf("unparseable line %q", line)
+	}
+	return m
+}
+
+// expect skips messages until one with the given command.
+func (tc *testClient) expect(command string) *ircbuf.Message {
+	tc.t.Helper()
+	for {
+		if m := tc.read(); m.Command == command {
+			return m
+		}
+	}
+}
+
+// sync waits for everything sent so far to be handled, skipping any replies.
+func (tc *testClient) sync() {
+	tc.t.Helper()
+	tc.send("PING :sync")
+	for {
+		if m := tc.expect("PONG"); m.Params[len(m.Params)-1] == "sync" {
+			return
+		}
+	}
+}
+
+func TestEmptyMessage(t *testing.T) {
+	_, addr := newTestServer(t)
+
+	// Lines that parse to nothing are skipped, before and after registration.
+	tc := dialTest(t, addr)
+	tc.send("@a=b")
+	tc.send("")
+	tc.send("@a=b ")
+	tc.send("NICK alice")
+	tc.send("USER alice 0 * :Alice")
+	tc.expect("422")
+
+	tc.send("@a=b")
+	tc.send("")
+	tc.sync()
+}
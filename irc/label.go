@@ -0,0 +1,140 @@
+package irc
+
+import (
+	"github.com/dgl/redisircd/ircbuf"
+
+	"gopkg.in/sorcix/irc.v2"
+)
+
+// Labeled responses are found by passing markers through the user's output
+// queue, messages without a command. The start is sent before the command is
+// handled, the end once the nick and channel servers have handled everything
+// the command sent them, so has to come after any of their replies. Responses
+// in between are marked with an internal label tag by whatever sends them,
+// anything else is unrelated and sent as normal.
+
+func (u *User) labelStart(label string) {
+	u.SendTags(ircbuf.Tags{"label": label}, &irc.Message{Params: []string{"+"}})
+}
+
+func (u *User) labelEnd(label string) {
+	u.SendTags(ircbuf.Tags{"label": label}, &irc.Message{Params: []string{"-"}})
+}
+
+// labelTags returns tags with the internal label tag added, the tags may be
+// shared with other recipients so are copied.
+func labelTags(tags ircbuf.Tags, label string) ircbuf.Tags {
+	t := ircbuf.Tags{"label": label}
+	for k, v := range tags {
+		if k != "label" {
+			t[k] = v
+		}
+	}
+	return t
+}
+
+// labelBegin starts a labeled command, the nick and channel servers mark what
+// they send the user as responses to it until labelSync.
+func (c *Client) labelBegin(label string) {
+	c.label = label
+	c.User.labelStart(label)
+	done := make(chan bool, 1)
+	c.Server.ns.send(nickRequest{Type: NR_LABEL, User: c.User, Params: []string{label}, Done: done})
+	<-done
+}
+
+// labelSync finishes a labeled command, the channel server sends labelEnd once
+// the nick server has passed on the sync. The next command has to wait, so
+// nothing it sends is taken as a response.
+func (c *Client) labelSync() {
+	done := make(chan bool, 1)
+	c.Server.ns.send(nickRequest{Type: NR_SYNC, User: c.User, Done: done})
+	<-done
+	c.label = ""
+}
+
+// responder sends messages from the nick or channel server to users, marking
+// them as responses if the user the request being handled is from has a
+// labeled command in progress. Each server has its own, only used on its
+// goroutine.
+type responder struct {
+	server *Server
+	// Labels of commands in progress, between NR_LABEL/CR_LABEL and the sync
+	labels map[*User]string
+	// The user the current request is from
+	current *User
+}
+
+func (r *responder) sendTagsTo(u *User, tags ircbuf.Tags, msg *irc.Message) {
+	if label, ok := r.labels[u]; ok && u == r.current {
+		tags = labelTags(tags, label)
+	}
+	u.SendTags(tags, msg)
+}
+
+func (r *responder) sendTo(u *User, msg *irc.Message) {
+	r.sendTagsTo(u, nil, msg)
+}
+
+// reply sends a numeric reply from the server to the user.
+func (r *responder) reply(u *User, numeric string, params ...string) {
+	r.sendTo(u, &irc.Message{
+		Prefix:  &irc.Prefix{Name: r.server.Name},
+		Command: numeric,
+		Params:  append([]string{u.Nick}, params...)})
+}
+
+// sendLabelled sends the responses to a labeled command, as a batch if there
+// is more than one, or an ACK if there were none.
+func (u *User) sendLabelled(label string, msgs []*ircbuf.Message) {
+	server := u.client.Server
+	if len(msgs) == 0 {
+		u.client.EncodeMessage(&ircbuf.Message{
+			Tags: ircbuf.Tags{"label": label},
+			Message: &irc.Message{
+				Prefix:  &irc.Prefix{Name: server.Name},
+				Command: "ACK",
+			}})
+		return
+	}
+
+	if len(msgs) == 1 {
+		tags := u.filterTags(msgs[0].Tags)
+		if tags == nil {
+			tags = ircbuf.Tags{}
+		}
+		tags["label"] = label
+		u.client.EncodeMessage(&ircbuf.Message{Tags: tags, Message: msgs[0].Message})
+		return
+	}
+
+	batch := ""
+	if u.hasCap("batch") {
+		batch = newMsgID()
+		u.client.EncodeMessage(&ircbuf.Message{
+			Tags: ircbuf.Tags{"label": label},
+			Message: &irc.Message{
+				Prefix:  &irc.Prefix{Name: server.Name},
+				Command: "BATCH",
+				Params:  []string{"+" + batch, "labeled-response"},
+			}})
+	}
+	for _, m := range msgs {
+		tags := u.filterTags(m.Tags)
+		if _, nested := tags["batch"]; len(batch) > 0 && !nested {
+			if tags == nil {
+				tags = ircbuf.Tags{}
+			}
+			tags["batch"] = batch
+		}
+		u.client.EncodeMessage(&ircbuf.Message{Tags: tags, Message: m.Message})
+	}
+	if len(batch) > 0 {
+		u.client.EncodeMessage(&ircbuf.Message{
+			Message: &irc.Message{
+				Prefix:  &irc.Prefix{Name: server.Name},
+				Command: "BATCH",
+				Params:  []string{"-" + batch},
+			}})
+	}
+}
@@ -0,0 +1,62 @@
+package irc
+
+import "testing"
+
+func TestLabeledResponse(t *testing.T) {
+	_, addr := newTestServer(t)
+	alice := register(t, addr, "alice", "labeled-response", "batch", "echo-message", "message-tags")
+	bob := register(t, addr, "bob")
+
+	// A single reply is labeled directly.
+	alice.send("@label=one PING :tok")
+	if m := alice.read(); m.Command != "PONG" || m.Tags["label"] != "one" {
+		t.Errorf("PING reply = %v %v, want PONG labeled one", m.Tags, m)
+	}
+
+	// Multiple replies are sent in a labeled batch.
+	alice.send("@label=two WHOIS bob")
+	start := alice.read()
+	if start.Command != "BATCH" || start.Tags["label"] != "two" || len(start.Params) < 2 ||
+		start.Params[1] != "labeled-response" || start.Params[0][0] != '+' {
+		t.Fatalf("WHOIS reply = %v %v, want labeled BATCH start", start.Tags, start)
+	}
+	ref := start.Params[0][1:]
+	var replies []string
+	for {
+		m := alice.read()
+		if m.Command == "BATCH" {
+			if m.Params[0] != "-"+ref {
+				t.Errorf("BATCH end = %v, want -%v", m, ref)
+			}
+			break
+		}
+		if m.Tags["batch"] != ref || len(m.Tags["label"]) > 0 {
+			t.Errorf("%v %v not in batch %v", m.Tags, m, ref)
+		}
+		replies = append(replies, m.Command)
+	}
+	if len(replies) < 2 || replies[0] != "311" || replies[len(replies)-1] != "318" {
+		t.Errorf("WHOIS batch = %v, want 311 ... 318", replies)
+	}
+
+	alice.send("JOIN #x")
+	alice.sync()
+	bob.send("JOIN #x")
+	bob.sync()
+	alice.sync()
+
+	// The echo is the reply, others get the message without the label.
+	alice.send("@label=three PRIVMSG #x :hello")
+	if m := alice.read(); m.Command != "PRIVMSG" || m.Tags["label"] != "three" || m.Params[1] != "hello" {
+		t.Errorf("PRIVMSG echo = %v %v, want PRIVMSG labeled three", m.Tags, m)
+	}
+	if m := bob.expect("PRIVMSG"); len(m.Tags["label"]) > 0 {
+		t.Errorf("PRIVMSG to bob = %v %v, want no label", m.Tags, m)
+	}
+
+	// Later messages from someone else aren't labeled.
+	bob.send("PRIVMSG #x :back")
+	if m := alice.expect("PRIVMSG"); len(m.Tags["label"]) > 0 || m.Params[1] != "back" {
+		t.Errorf("PRIVMSG from bob = %v %v, want no label", m.Tags, m)
+	}
+}
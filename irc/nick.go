@@ -1,17 +1,36 @@
 package irc
 
 import (
-	"net"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/dgl/redisircd/ircbuf"
+
+	"github.com/mediocregopher/radix/v4"
 	"gopkg.in/sorcix/irc.v2"
 )
 
+const (
+	// Number of nicks remembered for WHOWAS
+	whowasLength = 100
+)
+
 // nickServer runs in a goroutine and manages nicknames
 type nickServer struct {
-	nicks  map[string]*User
-	server *Server
+	nicks   map[string]*User
+	history []whowas
+	responder
 	sendCh chan<- nickRequest
+	// Requests for the channel server, see forward
+	forwardCh chan<- chanRequest
+}
+
+// whowas is a nick no longer in use, either after a nick change or quit.
+type whowas struct {
+	Prefix   *irc.Prefix
+	Realname string
+	Time     time.Time
 }
 
 type nickReqType int
@@ -22,6 +41,20 @@ const (
 	NR_PRIVMSG
 	NR_NOTICE
 	NR_QUIT
+	NR_WHO
+	NR_LOOKUP
+	NR_WHOWAS
+	NR_TAGMSG
+	NR_LABEL
+	NR_SYNC
+	NR_AWAY
+	NR_ACCOUNT
+	NR_LUSERS
+	NR_OPER
+	NR_UMODE
+	NR_UMODES
+	NR_SNOTICE
+	NR_WALLOPS
 )
 
 type nickRequest struct {
@@ -30,23 +63,31 @@ type nickRequest struct {
 	Client *Client
 	User   *User
 	Params []string
+	Tags   ircbuf.Tags
 	Reply  chan *User
+	Count  chan int
+	Done   chan bool
+	Modes  chan userModes
 }
 
 func NewNickServer(server *Server) *nickServer {
 	reqCh := make(chan nickRequest, 100)
+	forwardCh := make(chan chanRequest)
 
 	ns := &nickServer{
-		nicks:  make(map[string]*User),
-		server: server,
-		sendCh: reqCh,
+		nicks:     make(map[string]*User),
+		responder: responder{server: server, labels: make(map[*User]string)},
+		sendCh:    reqCh,
+		forwardCh: forwardCh,
 	}
 	go ns.run(reqCh)
+	go forwarder(forwardCh, server.cs)
 	return ns
 }
 
 func (ns *nickServer) run(reqCh <-chan nickRequest) {
 	for req := range reqCh {
+		ns.current = req.User
 		switch req.Type {
 		case NR_NEW:
 			var user *User
@@ -54,24 +95,37 @@ func (ns *nickServer) run(reqCh <-chan nickRequest) {
 				// Not already in use
 				user = NewUser(req.Client)
 				user.Nick = req.Name
+				user.Account = req.Client.account
 				user.Prefix = &irc.Prefix{
 					Name: req.Name,
 					User: req.Client.username,
-					Host: req.Client.tcpConn.RemoteAddr().(*net.TCPAddr).IP.String()}
+					Host: req.Client.host()}
 
 				ns.nicks[strings.ToLower(req.Name)] = user
 			}
 			req.Reply <- user
 		case NR_CHANGE:
 			var user *User
-			// XXX: needs to keep old prefix, then update channels, then update prefix
-			/*if _, ok := ns.nicks[strings.ToLower(req.Name)]; !ok {
-				oldNick := strings.ToLower(req.User.Nick)
-				// Not already in use
-				ns.nicks[strings.ToLower(req.Name)] = req.User
-				req.User.Nick = req.Name
+			newNick := strings.ToLower(req.Name)
+			oldNick := strings.ToLower(req.User.Nick)
+			if u, ok := ns.nicks[newNick]; !ok || u == req.User {
+				// Not in use (or just a case change of the user's own nick). Replace
+				// rather than modify the prefix, messages already queued hold the old
+				// one.
+				ns.remember(req.User)
+				if len(req.User.Away) > 0 {
+					ns.awayRedis(req.User.Nick, "")
+					ns.awayRedis(req.Name, req.User.Away)
+				}
 				delete(ns.nicks, oldNick)
-			}*/
+				ns.nicks[newNick] = req.User
+				req.User.Nick = req.Name
+				req.User.Prefix = &irc.Prefix{
+					Name: req.Name,
+					User: req.User.Prefix.User,
+					Host: req.User.Prefix.Host}
+				user = req.User
+			}
 			req.Reply <- user
 		case NR_PRIVMSG, NR_NOTICE:
 			if user, ok := ns.nicks[strings.ToLower(req.Name)]; ok {
@@ -79,22 +133,101 @@ func (ns *nickServer) run(reqCh <-chan nickRequest) {
 				if req.Type == NR_NOTICE {
 					cmd = "NOTICE"
 				}
-				user.Send(&irc.Message{
-					Prefix: req.User.Prefix,
+				tags := messageTags(req.Tags, time.Now())
+				msg := &irc.Message{
+					Prefix:  req.User.Prefix,
 					Command: cmd,
-					Params: []string{req.Name, req.Params[0]},
-				})
+					Params:  []string{req.Name, req.Params[0]},
+				}
+				ns.sendTagsTo(user, tags, msg)
+				if req.User.hasCap("echo-message") {
+					ns.sendTagsTo(req.User, tags, msg)
+				}
+				if cmd == "PRIVMSG" && len(user.Away) > 0 {
+					ns.reply(req.User, irc.RPL_AWAY, user.Nick, user.Away)
+				}
+			} else if req.Type == NR_PRIVMSG && len(req.Params) > 1 {
+				// A CTCP request, maybe for a Redis nick.
+				ns.forward(chanRequest{Type: CR_CTCP, Name: req.Name, User: req.User, Params: req.Params, Tags: req.Tags})
 			} else {
-				/*req.User.Send(&irc.Message{
-					Prefix:  &irc.Prefix{Name: ns.server.Name},
-					Command: irc.ERR_NOSUCHCHANNEL, // XXX
-					Params:  []string{req.User.Nick, req.Name, "No such nick"}})*/
+				ns.reply(req.User, irc.ERR_NOSUCHNICK, req.Name, "No such nick/channel")
+			}
+		case NR_TAGMSG:
+			if user, ok := ns.nicks[strings.ToLower(req.Name)]; ok {
+				tags := messageTags(req.Tags, time.Now())
+				msg := &irc.Message{
+					Prefix:  req.User.Prefix,
+					Command: "TAGMSG",
+					Params:  []string{req.Name},
+				}
+				if user.hasCap("message-tags") {
+					ns.sendTagsTo(user, tags, msg)
+				}
+				if req.User.hasCap("echo-message") {
+					ns.sendTagsTo(req.User, tags, msg)
+				}
+			} else {
+				ns.reply(req.User, irc.ERR_NOSUCHNICK, req.Name, "No such nick/channel")
 			}
 		case NR_QUIT:
+			if req.User != nil {
+				ns.remember(req.User)
+				if len(req.User.Away) > 0 {
+					ns.awayRedis(req.User.Nick, "")
+				}
+			}
 			delete(ns.nicks, strings.ToLower(req.Name))
+			delete(ns.labels, req.User)
 			if req.Reply != nil {
 				req.Reply <- nil
 			}
+		case NR_WHO:
+			ns.who(req.User, req.Name)
+		case NR_LOOKUP:
+			req.Reply <- ns.nicks[strings.ToLower(req.Name)]
+		case NR_WHOWAS:
+			ns.whowas(req.User, req.Name, req.Params)
+		case NR_LABEL:
+			// Passed on so the channel server sees it after anything this has
+			// already sent it for the user.
+			ns.labels[req.User] = req.Params[0]
+			ns.forward(chanRequest{Type: CR_LABEL, User: req.User, Params: req.Params, Reply: req.Done})
+		case NR_SYNC:
+			// All earlier replies to this user have been sent, the channel
+			// server finishes the sync.
+			delete(ns.labels, req.User)
+			ns.forward(chanRequest{Type: CR_SYNC, User: req.User, Reply: req.Done})
+		case NR_LUSERS:
+			// The number of visible users, then invisible.
+			invisible := 0
+			for _, u := range ns.nicks {
+				if u.hasMode(UM_INVISIBLE) {
+					invisible++
+				}
+			}
+			req.Count <- len(ns.nicks) - invisible
+			req.Count <- invisible
+		case NR_OPER:
+			req.User.setMode(UM_OPER, true)
+			ns.sendTo(req.User, &irc.Message{
+				Prefix:  req.User.Prefix,
+				Command: "MODE",
+				Params:  []string{req.User.Nick, "+o"}})
+			req.Reply <- req.User
+		case NR_UMODE:
+			ns.umode(req.User, req.Params)
+		case NR_UMODES:
+			req.Modes <- req.User.modes()
+		case NR_SNOTICE:
+			ns.snotice(req.Params[0])
+		case NR_WALLOPS:
+			ns.wallops(req.User, req.Params[0])
+		case NR_AWAY:
+			ns.away(req.User, req.Params[0])
+		case NR_ACCOUNT:
+			// Authenticated after connecting.
+			req.User.Account = req.Params[0]
+			ns.forward(chanRequest{Type: CR_NOTIFY, User: req.User, Params: []string{"account-notify", "ACCOUNT", req.Params[0]}})
 		}
 	}
 }
@@ -102,3 +235,151 @@ func (ns *nickServer) run(reqCh <-chan nickRequest) {
 func (ns *nickServer) send(req nickRequest) {
 	ns.sendCh <- req
 }
+
+// forward passes a request on to the channel server without waiting for it,
+// the channel server can itself be waiting on the nick server (e.g. Redis
+// publishing a server notice).
+func (ns *nickServer) forward(req chanRequest) {
+	ns.forwardCh <- req
+}
+
+// forwarder queues requests from the nick server for the channel server,
+// keeping them in order.
+func forwarder(in <-chan chanRequest, cs *chanServer) {
+	var queue []chanRequest
+	for {
+		var out chan<- chanRequest
+		var next chanRequest
+		if len(queue) > 0 {
+			out, next = cs.sendCh, queue[0]
+		}
+		select {
+		case req := <-in:
+			queue = append(queue, req)
+		case out <- next:
+			queue = queue[1:]
+		}
+	}
+}
+
+func (ns *nickServer) remember(user *User) {
+	ns.history = append(ns.history, whowas{
+		Prefix:   user.Prefix,
+		Realname: user.realname(),
+		Time:     time.Now(),
+	})
+	if len(ns.history) > whowasLength {
+		ns.history = ns.history[len(ns.history)-whowasLength:]
+	}
+}
+
+// who replies with all users matching the mask, by nick, username, host or
+// realname.
+func (ns *nickServer) who(user *User, mask string) {
+	if mask == "" || mask == "0" {
+		mask = "*"
+	}
+	for _, u := range ns.nicks {
+		if u.hasMode(UM_INVISIBLE) && u != user && !user.hasMode(UM_OPER) {
+			continue
+		}
+		if matchMask(mask, u.Nick) || matchMask(mask, u.Prefix.User) ||
+			matchMask(mask, u.Prefix.Host) || matchMask(mask, u.realname()) {
+			ns.whoReply(user, u, "*", "")
+		}
+	}
+	ns.reply(user, irc.RPL_ENDOFWHO, mask, "End of WHO list")
+}
+
+func (ns *nickServer) whowas(user *User, nick string, params []string) {
+	count := 0
+	if len(params) > 0 {
+		count, _ = strconv.Atoi(params[0])
+	}
+
+	found := 0
+	for i := len(ns.history) - 1; i >= 0; i-- {
+		h := ns.history[i]
+		if strings.ToLower(h.Prefix.Name) != strings.ToLower(nick) {
+			continue
+		}
+		ns.reply(user, irc.RPL_WHOWASUSER, h.Prefix.Name, h.Prefix.User, h.Prefix.Host, "*", h.Realname)
+		ns.reply(user, irc.RPL_WHOISSERVER, h.Prefix.Name, ns.server.Name, h.Time.UTC().Format(time.RFC1123))
+		found++
+		if count > 0 && found >= count {
+			break
+		}
+	}
+	if found == 0 {
+		ns.reply(user, irc.ERR_WASNOSUCHNICK, nick, "There was no such nickname")
+	}
+	ns.reply(user, irc.RPL_ENDOFWHOWAS, nick, "End of WHOWAS")
+}
+
+// away marks the user as away (or not with an empty message), telling anyone
+// interested via the channel server and Redis.
+func (ns *nickServer) away(user *User, message string) {
+	user.Away = message
+	ns.awayRedis(user.Nick, message)
+
+	params := []string{"away-notify", "AWAY"}
+	if len(message) > 0 {
+		ns.reply(user, irc.RPL_NOWAWAY, "You have been marked as being away")
+		params = append(params, message)
+	} else {
+		ns.reply(user, irc.RPL_UNAWAY, "You are no longer marked as being away")
+	}
+	ns.forward(chanRequest{Type: CR_NOTIFY, User: user, Params: params})
+}
+
+// awayRedis updates the AwayKey hash in Redis, so things outside IRC can see
+// who is around.
+func (ns *nickServer) awayRedis(nick, message string) {
+	if len(ns.server.AwayKey) == 0 {
+		return
+	}
+	key := ns.server.awayKey()
+	if len(message) > 0 {
+		ns.server.redis.do(radix.Cmd(nil, "HSET", key, nick, message))
+	} else {
+		ns.server.redis.do(radix.Cmd(nil, "HDEL", key, nick))
+	}
+}
+
+// umode changes the user's own modes, or with no params replies with them.
+// +o can only be set by OPER.
+func (ns *nickServer) umode(user *User, params []string) {
+	if len(params) == 0 {
+		ns.reply(user, irc.RPL_UMODEIS, user.umodes())
+		return
+	}
+
+	var modeChange strings.Builder
+	state := '+'
+	for _, c := range params[0] {
+		if c == '+' || c == '-' {
+			state = c
+			continue
+		}
+		flag, ok := userModeChars[c]
+		if !ok {
+			ns.reply(user, irc.ERR_UMODEUNKNOWNFLAG, "Unknown MODE flag")
+			continue
+		}
+		if state == '+' && flag != UM_OPER && !user.hasMode(flag) {
+			user.setMode(flag, true)
+		} else if state == '-' && user.hasMode(flag) {
+			user.setMode(flag, false)
+		} else {
+			continue
+		}
+		modeChange.WriteRune(state)
+		modeChange.WriteRune(c)
+	}
+	if modeChange.Len() > 0 {
+		ns.sendTo(user, &irc.Message{
+			Prefix:  user.Prefix,
+			Command: "MODE",
+			Params:  []string{user.Nick, modeChange.String()}})
+	}
+}
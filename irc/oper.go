@@ -0,0 +1,209 @@
+package irc
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"text/template"
+
+	"github.com/dgl/redisircd/ircbuf"
+
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/sorcix/irc.v2"
+)
+
+// Rehash reloads the configuration that can change while running: the
+// operators from OperFile, lines of name and bcrypt hash separated by
+// whitespace, and the templates from TemplateFile. Channels already using a
+// template keep the old one until +F is set again.
+func (s *Server) Rehash() error {
+	opers := map[string]string{}
+	if len(s.OperFile) > 0 {
+		f, err := os.Open(s.OperFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if len(line) == 0 || line[0] == '#' {
+				continue
+			}
+			fields := strings.Fields(line)
+			if len(fields) != 2 {
+				return fmt.Errorf("%s: expected name and hash: %q", s.OperFile, line)
+			}
+			opers[fields[0]] = fields[1]
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	}
+
+	var templates *template.Template
+	if len(s.TemplateFile) > 0 {
+		var err error
+		if templates, err = parseTemplates(s.TemplateFile); err != nil {
+			return err
+		}
+	}
+
+	s.opersMu.Lock()
+	s.opers = opers
+	s.opersMu.Unlock()
+	s.templatesMu.Lock()
+	s.templates = templates
+	s.templatesMu.Unlock()
+	return nil
+}
+
+func (s *Server) checkOper(name, password string) bool {
+	s.opersMu.RLock()
+	hash, ok := s.opers[name]
+	s.opersMu.RUnlock()
+	return ok && bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// notice sends a server notice to operators, as well as logging it.
+func (s *Server) notice(format string, args ...interface{}) {
+	text := fmt.Sprintf(format, args...)
+	log.Print(text)
+	s.ns.send(nickRequest{Type: NR_SNOTICE, Params: []string{text}})
+}
+
+func (ns *nickServer) snotice(text string) {
+	for _, u := range ns.nicks {
+		if u.hasMode(UM_OPER) {
+			ns.sendTo(u, &irc.Message{
+				Prefix:  &irc.Prefix{Name: ns.server.Name},
+				Command: "NOTICE",
+				Params:  []string{u.Nick, "*** Notice -- " + text}})
+		}
+	}
+}
+
+// wallops sends a WALLOPS from user to everyone with +w.
+func (ns *nickServer) wallops(user *User, text string) {
+	msg := &irc.Message{
+		Prefix:  user.Prefix,
+		Command: "WALLOPS",
+		Params:  []string{text},
+	}
+	for _, u := range ns.nicks {
+		if u.hasMode(UM_WALLOPS) {
+			ns.sendTo(u, msg)
+		}
+	}
+}
+
+// requireOper replies with ERR_NOPRIVILEGES unless the user is an operator.
+func (c *Client) requireOper() bool {
+	// Modes are only written by the nick server, so ask it.
+	req := nickRequest{Type: NR_UMODES, User: c.User, Modes: make(chan userModes)}
+	c.Server.ns.send(req)
+	if <-req.Modes&UM_OPER == 0 {
+		c.reply(irc.ERR_NOPRIVILEGES, "Permission Denied- You're not an IRC operator")
+		return false
+	}
+	return true
+}
+
+func (c *Client) oper(m *ircbuf.Message) error {
+	if len(m.Params) < 2 {
+		c.reply(irc.ERR_NEEDMOREPARAMS, "OPER", "Not enough parameters")
+		return nil
+	}
+
+	name := m.Params[0]
+	if !c.Server.checkOper(name, m.Params[1]) {
+		c.reply(irc.ERR_PASSWDMISMATCH, "Password incorrect")
+		c.Server.notice("Failed OPER attempt as %s by %s", name, c.User.Prefix)
+		return nil
+	}
+
+	req := nickRequest{Type: NR_OPER, User: c.User, Reply: make(chan *User)}
+	c.Server.ns.send(req)
+	<-req.Reply
+	c.reply(irc.RPL_YOUREOPER, "You are now an IRC operator")
+	c.Server.notice("%s is now an operator (%s)", c.User.Prefix, name)
+	return nil
+}
+
+func (c *Client) kill(m *ircbuf.Message) error {
+	if !c.requireOper() {
+		return nil
+	}
+	if len(m.Params) < 1 {
+		c.reply(irc.ERR_NEEDMOREPARAMS, "KILL", "Not enough parameters")
+		return nil
+	}
+
+	nick, reason := m.Params[0], "No reason given"
+	if len(m.Params) > 1 && len(m.Params[1]) > 0 {
+		reason = m.Params[1]
+	}
+	req := nickRequest{
+		Type:  NR_LOOKUP,
+		Name:  nick,
+		Reply: make(chan *User),
+	}
+	c.Server.ns.send(req)
+	target := <-req.Reply
+	if target == nil {
+		c.reply(irc.ERR_NOSUCHNICK, nick, "No such nick/channel")
+		return nil
+	}
+
+	c.Server.notice("%s killed %s (%s)", c.User.Nick, target.Nick, reason)
+	target.client.disconnect(fmt.Sprintf("Killed (%s (%s))", c.User.Nick, reason))
+	return nil
+}
+
+// disconnect closes the client's connection, from another client's goroutine.
+// Only reading is stopped, so the client's own goroutine can still send the
+// QUIT and ERROR.
+func (c *Client) disconnect(reason string) {
+	select {
+	case c.killed <- reason:
+	default:
+		// Already being killed
+		return
+	}
+	if tcpConn, ok := c.tcpConn.(*net.TCPConn); ok {
+		tcpConn.CloseRead()
+	} else {
+		c.tcpConn.Close()
+	}
+}
+
+func (c *Client) wallops(m *ircbuf.Message) error {
+	if !c.requireOper() {
+		return nil
+	}
+	if len(m.Params) < 1 || len(m.Params[0]) == 0 {
+		c.reply(irc.ERR_NEEDMOREPARAMS, "WALLOPS", "Not enough parameters")
+		return nil
+	}
+
+	c.Server.ns.send(nickRequest{Type: NR_WALLOPS, User: c.User, Params: m.Params[:1]})
+	return nil
+}
+
+func (c *Client) rehash(m *ircbuf.Message) error {
+	if !c.requireOper() {
+		return nil
+	}
+
+	c.reply(irc.RPL_REHASHING, "config", "Rehashing")
+	if err := c.Server.Rehash(); err != nil {
+		c.Server.notice("%s failed to rehash: %v", c.User.Nick, err)
+	} else {
+		c.Server.notice("%s rehashed the server", c.User.Nick)
+	}
+	return nil
+}
@@ -4,8 +4,11 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"strings"
 	"time"
 
+	"github.com/dgl/redisircd/ircbuf"
+
 	"gopkg.in/sorcix/irc.v2"
 )
 
@@ -18,6 +21,9 @@ var preCommands = commandMap{
 	"USER": (*Client).preUser,
 	"NICK": (*Client).preNick,
 	"PING": (*Client).ping,
+	"CAP":  (*Client).cap,
+
+	"AUTHENTICATE": (*Client).authenticate,
 
 	"GET":     (*Client).maybeHTTP,
 	"HEAD":    (*Client).maybeHTTP,
@@ -29,11 +35,18 @@ func (c *Client) pre() error {
 	for {
 		c.tcpConn.SetReadDeadline(time.Now().Add(timeoutDuration))
 		message, err := c.Decode()
-		if err != nil || message == nil {
+		if err == ircbuf.ErrInvalidUTF8 {
+			c.invalidUTF8(message)
+			continue
+		}
+		if err != nil {
 			log.Printf("Decode error: %v", err)
 			return err
 		}
-		c.last = time.Now()
+		if message == nil {
+			continue
+		}
+		c.active()
 		if c.Server.Debug {
 			log.Print(message)
 		}
@@ -60,13 +73,50 @@ func (c *Client) reply(numeric string, params ...string) {
 	if len(c.nick) > 0 {
 		nick = c.nick
 	}
-	c.Encode(&irc.Message{
+	c.send(&irc.Message{
 		Prefix:  &irc.Prefix{Name: c.Server.Name},
 		Command: numeric,
 		Params:  append([]string{nick}, params...)})
 }
 
-func (c *Client) preQuit(m *irc.Message) error {
+// send sends a message to the client. Once connected it goes via the user's
+// output, so is kept in order with replies from the nick and channel servers.
+func (c *Client) send(m *irc.Message) {
+	c.sendTags(nil, m)
+}
+
+// sendTags sends a message with IRCv3 tags, marked as a response if a labeled
+// command is being handled.
+func (c *Client) sendTags(tags ircbuf.Tags, m *irc.Message) {
+	if !c.connected {
+		c.Encode(m)
+		return
+	}
+	if len(c.label) > 0 {
+		tags = labelTags(tags, c.label)
+	}
+	c.User.SendTags(tags, m)
+}
+
+// fail sends an IRCv3 standard reply FAIL.
+func (c *Client) fail(command, code string, params ...string) {
+	c.send(&irc.Message{
+		Prefix:  &irc.Prefix{Name: c.Server.Name},
+		Command: "FAIL",
+		Params:  append([]string{command, code}, params...)})
+}
+
+// invalidUTF8 rejects a message that isn't UTF-8, as described by UTF8ONLY.
+func (c *Client) invalidUTF8(m *ircbuf.Message) {
+	// The line may not have parsed at all.
+	command := "*"
+	if m != nil {
+		command = m.Command
+	}
+	c.fail(command, "INVALID_UTF8", "Message rejected, your IRC software MUST use UTF-8 encoding on this network")
+}
+
+func (c *Client) preQuit(m *ircbuf.Message) error {
 	message := ""
 	if len(m.Params) > 0 {
 		message = m.Params[0]
@@ -78,7 +128,7 @@ func (c *Client) preQuit(m *irc.Message) error {
 	return errors.New("QUIT :" + message)
 }
 
-func (c *Client) preUser(m *irc.Message) error {
+func (c *Client) preUser(m *ircbuf.Message) error {
 	if len(m.Params) < 4 {
 		c.reply(irc.ERR_NEEDMOREPARAMS, "USER", "Not enough parameters")
 		return nil
@@ -89,13 +139,11 @@ func (c *Client) preUser(m *irc.Message) error {
 	// TODO: Truncate realname?
 	c.Realname = m.Params[3]
 
-	if len(c.nick) > 0 {
-		c.connect()
-	}
+	c.maybeConnect()
 	return nil
 }
 
-func (c *Client) preNick(m *irc.Message) error {
+func (c *Client) preNick(m *ircbuf.Message) error {
 	if len(m.Params) < 1 {
 		c.reply(irc.ERR_NONICKNAMEGIVEN, "No nickname given")
 		return nil
@@ -108,13 +156,24 @@ func (c *Client) preNick(m *irc.Message) error {
 
 	c.nick = m.Params[0]
 
-	if len(c.Realname) > 0 {
+	c.maybeConnect()
+	return nil
+}
+
+// maybeConnect registers the client once NICK and USER have been given, and
+// any capability negotiation has finished.
+func (c *Client) maybeConnect() {
+	if len(c.nick) > 0 && c.nick != "*" && len(c.username) > 0 && !c.capNegotiating {
 		c.connect()
 	}
-	return nil
 }
 
 func (c *Client) connect() {
+	if len(c.account) > 0 {
+		// Authenticated, so the username can be trusted.
+		c.username = strings.TrimPrefix(c.username, "~")
+	}
+
 	req := nickRequest{
 		Type:   NR_NEW,
 		Name:   c.nick,
@@ -131,15 +190,50 @@ func (c *Client) connect() {
 		return
 	}
 	c.User = u
+	c.signon = time.Now()
 
 	c.reply(irc.RPL_WELCOME, fmt.Sprintf("Welcome to something like IRC, %s", c.nick))
-	debug := ""
-	if c.Server.Debug {
-		debug = "[DEBUG]"
+	v := c.Server.version()
+	c.reply(irc.RPL_YOURHOST, fmt.Sprintf("Your host is %s, running version %s", c.Server.Name, v))
+	chanModes, chanParamModes := chanModeInfo()
+	c.reply(irc.RPL_MYINFO, c.Server.Name, v, "BDiow", chanModes, chanParamModes)
+	c.isupport()
+}
+
+// isupport sends RPL_ISUPPORT (005), split over multiple lines as clients
+// only accept 13 parameters per line.
+func (c *Client) isupport() {
+	tokens := []string{
+		"CASEMAPPING=ascii",
+		"CHANTYPES=#$",
+		"CHANMODES=" + strings.Join(chanModeTypes[:], ","),
+		"NICKLEN=12",
+		"PREFIX=(ov)@+",
+		"EXCEPTS",
+		"INVEX",
+		fmt.Sprintf("MAXLIST=beI:%d", maxListEntries),
+		fmt.Sprintf("TOPICLEN=%d", topicLen),
+		"ELIST=MNU",
+		"SAFELIST",
+		fmt.Sprintf("AWAYLEN=%d", awayLen),
+		"BOT=B",
+		fmt.Sprintf("TARGMAX=NOTICE:%d,PRIVMSG:%d,TAGMSG:%d", maxTargets, maxTargets, maxTargets),
+	}
+	if c.Server.UTF8Only {
+		tokens = append(tokens, "UTF8ONLY")
+	}
+	if len(c.Server.HistoryKey) > 0 {
+		tokens = append(tokens,
+			fmt.Sprintf("CHATHISTORY=%d", historyMaxLimit),
+			"MSGREFTYPES=msgid,timestamp")
 	}
-	v := fmt.Sprintf("%s-%s%s", NAME, VERSION, debug)
 
-	c.reply(irc.RPL_YOURHOST, fmt.Sprintf("Your host is %s, running version %s", c.Server.Name, v))
-	c.reply(irc.RPL_MYINFO, c.Server.Name, v, "iw", "noR", "oR")
-	c.reply("005", "CASEMAPPING=ascii", "CHANTYPES=#$", "CHANMODES=,NT,R,JPn", "NICKLEN=12")
+	for len(tokens) > 0 {
+		n := len(tokens)
+		if n > 12 {
+			n = 12
+		}
+		c.reply("005", append(tokens[:n:n], "are supported by this server")...)
+		tokens = tokens[n:]
+	}
 }
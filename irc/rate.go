@@ -0,0 +1,40 @@
+package irc
+
+import "time"
+
+const (
+	// Minutes a message rate is averaged over
+	rateMinutes = 10
+)
+
+// msgRate counts messages in one minute buckets, to give a recent rate.
+type msgRate struct {
+	buckets [rateMinutes]int
+	minute  int64
+}
+
+func (r *msgRate) add(now time.Time) {
+	r.advance(now)
+	r.buckets[r.minute%rateMinutes]++
+}
+
+// perMinute is the average rate over the last rateMinutes minutes.
+func (r *msgRate) perMinute(now time.Time) float64 {
+	r.advance(now)
+	total := 0
+	for _, n := range r.buckets {
+		total += n
+	}
+	return float64(total) / rateMinutes
+}
+
+// advance clears any buckets for minutes that have passed since last used.
+func (r *msgRate) advance(now time.Time) {
+	minute := now.Unix() / 60
+	for m := r.minute + 1; m <= minute && m <= r.minute+rateMinutes; m++ {
+		r.buckets[m%rateMinutes] = 0
+	}
+	if minute > r.minute {
+		r.minute = minute
+	}
+}
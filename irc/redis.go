@@ -3,25 +3,177 @@ package irc
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"strings"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"github.com/dgl/redisircd/ircbuf"
 
 	"github.com/PaesslerAG/jsonpath"
 	"github.com/mediocregopher/radix/v4"
 	"gopkg.in/sorcix/irc.v2"
 )
 
-func redisPubsub(pubsub string, channel *channel, server *Server) chan<- *irc.Message {
-	ircCh := make(chan *irc.Message)
-	go redisPubsubMain(pubsub, channel, server, ircCh)
-	return ircCh
+const (
+	// How often a topic bound to a Redis key (+K) is checked
+	topicPollInterval = 10 * time.Second
+	// Maximum length of a tag value from +X, the limit on all client tags is
+	// 4094 bytes
+	maxTagValue = 512
+	// Writes waiting to be sent to Redis before new ones are dropped
+	redisQueueLength = 1000
+	// Longest a queued action can take, so a hung Redis doesn't stop the queue
+	redisQueueTimeout = 10 * time.Second
+	// Shortest split line, in case a long nick leaves little room for text
+	minSplitLength = 64
+)
+
+// redisQueue sends commands to Redis in the background, for the nick and
+// channel servers which must never block on it.
+type redisQueue struct {
+	server *Server
+	ch     chan redisRequest
+}
+
+// redisRequest is a queued action, done gets its result if anyone is waiting.
+type redisRequest struct {
+	action radix.Action
+	done   chan error
+}
+
+func newRedisQueue(server *Server) *redisQueue {
+	q := &redisQueue{
+		server: server,
+		ch:     make(chan redisRequest, redisQueueLength),
+	}
+	go q.run()
+	return q
+}
+
+// do queues an action, its result is ignored.
+func (q *redisQueue) do(a radix.Action) {
+	select {
+	case q.ch <- redisRequest{action: a}:
+	default:
+		log.Printf("Redis queue full, dropped %v", a.Properties().Keys)
+	}
 }
 
-func redisPubsubMain(pubsub string, channel *channel, server *Server, ircCh <-chan *irc.Message) {
+// doWait queues an action and waits for it to complete or ctx to be done, so
+// the connection is shared with writes. If ctx is done first the action may
+// still run later. Must not be called by the nick or channel servers.
+func (q *redisQueue) doWait(ctx context.Context, a radix.Action) error {
+	done := make(chan error, 1)
+	select {
+	case q.ch <- redisRequest{action: a, done: done}:
+	default:
+		return errors.New("redis queue full")
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (q *redisQueue) run() {
+	var conn radix.Conn
+	for r := range q.ch {
+		ctx, cancel := context.WithTimeout(context.Background(), redisQueueTimeout)
+		var err error
+		if conn == nil {
+			conn, err = radix.Dial(ctx, "tcp", q.server.RedisHost)
+			if err != nil {
+				log.Printf("Failed dial: %v", err)
+				conn = nil
+			}
+		}
+
+		if conn != nil {
+			if err = conn.Do(ctx, r.action); err != nil {
+				log.Printf("Failed command on %v: %v", r.action.Properties().Keys, err)
+				conn.Close()
+				conn = nil
+			}
+		}
+		cancel()
+		if r.done != nil {
+			r.done <- err
+		}
+	}
+}
+
+// redisSub is the channel server's side of a pubsub subscription (+R), run by
+// redisPubsubMain.
+type redisSub struct {
+	// Lines to publish to the pubsub's :out channel
+	out chan<- string
+	// The latest settings, see update
+	config chan redisConfig
+	// Set once subscribed, atomic
+	up int32
+}
+
+// redisConfig is a copy of the channel's Redis settings, as the pubsub
+// goroutine can't read the channel itself.
+type redisConfig struct {
+	Type, TextPath, NickPath, TimePath string
+	Tags                               []redisTagPath
+	Topic                              string
+	MaxLines                           int
+	Encoding                           string
+	Template                           *template.Template
+}
+
+func redisPubsub(pubsub, chanName string, server *Server) *redisSub {
+	ircCh := make(chan string)
+	sub := &redisSub{
+		out:    ircCh,
+		config: make(chan redisConfig, 1),
+	}
+	go redisPubsubMain(pubsub, chanName, server, ircCh, sub.config, &sub.up)
+	return sub
+}
+
+// update replaces any settings the pubsub goroutine hasn't seen yet with cfg,
+// without blocking.
+func (sub *redisSub) update(cfg redisConfig) {
+	select {
+	case <-sub.config:
+	default:
+	}
+	sub.config <- cfg
+}
+
+// subscribed is true once the goroutine has subscribed, so can publish. It
+// never will if it failed to connect.
+func (sub *redisSub) subscribed() bool {
+	return atomic.LoadInt32(&sub.up) == 1
+}
+
+// close stops the subscription.
+func (sub *redisSub) close() {
+	close(sub.out)
+}
+
+func redisPubsubMain(pubsub, chanName string, server *Server, ircCh <-chan string, configCh <-chan redisConfig, up *int32) {
+	// fail tells operators, then waits for the channel to be closed (e.g. by
+	// -R), so the channel server doesn't block publishing to it.
+	fail := func(format string, args ...interface{}) {
+		server.notice("Redis pubsub %v for %v: "+format, append([]interface{}{pubsub, chanName}, args...)...)
+		for range ircCh {
+		}
+	}
+	var cfg redisConfig
+
 	conn, err := radix.Dial(context.TODO(), "tcp", server.RedisHost)
 	if err != nil {
-		log.Printf("Failed dial: %v", err)
+		fail("failed dial: %v", err)
 		return
 	}
 	defer conn.Close()
@@ -31,7 +183,7 @@ func redisPubsubMain(pubsub string, channel *channel, server *Server, ircCh <-ch
 
 	pubConn, err := radix.Dial(context.TODO(), "tcp", server.RedisHost)
 	if err != nil {
-		log.Printf("Failed dial: %v", err)
+		fail("failed dial: %v", err)
 		return
 	}
 	defer pubConn.Close()
@@ -39,31 +191,95 @@ func redisPubsubMain(pubsub string, channel *channel, server *Server, ircCh <-ch
 	name := pubsub
 	err = pubsubClient.Subscribe(context.TODO(), msgCh, name)
 	if err != nil {
-		log.Printf("Failed subscribe: %v", err)
+		fail("failed subscribe: %v", err)
 		return
 	}
 
 	log.Printf("Subscribed to %v", name)
+	atomic.AddInt32(&server.redisSubs, 1)
+	defer atomic.AddInt32(&server.redisSubs, -1)
+	atomic.StoreInt32(up, 1)
+
+	topicTicker := time.NewTicker(topicPollInterval)
+	defer topicTicker.Stop()
+	lastTopic := ""
 
 	for {
 		select {
+		case cfg = <-configCh:
+
+		case <-topicTicker.C:
+			key := cfg.Topic
+			if len(key) == 0 || key[0] == '$' {
+				continue
+			}
+			var b []byte
+			err := pubConn.Do(context.TODO(), radix.Cmd(&b, "GET", key))
+			if err != nil {
+				log.Printf("Failed to get topic %q: %v", key, err)
+				continue
+			}
+			topic := toUTF8(b, cfg.Encoding)
+			if topic != lastTopic {
+				lastTopic = topic
+				redisSetTopic(name, chanName, server, topic)
+			}
+
 		case m := <-msgCh:
+			// Mode changes before the message should apply to it.
+			select {
+			case cfg = <-configCh:
+			default:
+			}
+
+			// Decoded first so JSON doesn't replace anything it can't decode.
+			m.Message = []byte(toUTF8(m.Message, cfg.Encoding))
 			text := string(m.Message)
 			name := name
+			ts := time.Now()
+			var tags ircbuf.Tags
 
-			if channel.redisType == "json" {
+			if cfg.Type == "json" {
 				var j interface{}
 				err := json.Unmarshal(m.Message, &j)
 				if err == nil {
-					if len(channel.redisTextPath) > 0 {
-						if res, err := jsonpath.Get(channel.redisTextPath, j); err != nil {
+					if t := cfg.Template; t != nil {
+						if res, err := renderTemplate(t, m.Message); err != nil {
+							text = fmt.Sprintf("%q [%v]", string(m.Message), err)
+						} else {
+							text = res
+						}
+					} else if len(cfg.TextPath) > 0 {
+						if res, err := jsonpath.Get(cfg.TextPath, j); err != nil {
 							text = fmt.Sprintf("%q [%v]", string(m.Message), err)
 						} else {
 							text = fmt.Sprintf("%v", res)
 						}
 					}
-					if len(channel.redisNickPath) > 0 {
-						if res, err := jsonpath.Get(channel.redisNickPath, j); err != nil {
+					if topicPath := cfg.Topic; len(topicPath) > 0 && topicPath[0] == '$' {
+						if res, err := jsonpath.Get(topicPath, j); err == nil {
+							if s, ok := res.(string); ok && len(s) > 0 {
+								redisSetTopic(name, chanName, server, s)
+							}
+						}
+					}
+					if len(cfg.TimePath) > 0 {
+						if res, err := jsonpath.Get(cfg.TimePath, j); err == nil {
+							if t, err := parseTimestamp(res); err == nil {
+								ts = t
+							}
+						}
+					}
+					if tps := cfg.Tags; len(tps) > 0 {
+						tags = ircbuf.Tags{}
+						for _, tp := range tps {
+							if res, err := jsonpath.Get(tp.Path, j); err == nil {
+								tags["+redisircd/"+tp.Name] = tagValue(res)
+							}
+						}
+					}
+					if len(cfg.NickPath) > 0 {
+						if res, err := jsonpath.Get(cfg.NickPath, j); err != nil {
 							name = "redis"
 							text = fmt.Sprintf("%q [%v]", string(m.Message), err)
 						} else if s, ok := res.(string); ok {
@@ -78,31 +294,121 @@ func redisPubsubMain(pubsub string, channel *channel, server *Server, ircCh <-ch
 				}
 			}
 
+			prefix := &irc.Prefix{
+				Name: name,
+				User: "auto",
+				Host: "redis",
+			}
+			// Split to fit what clients will actually be sent, tags aside.
+			max := maxLineLength - len(":"+prefix.String()+" PRIVMSG "+chanName+" :")
+			if max < minSplitLength {
+				max = minSplitLength
+			}
+			var lines []string
 			for _, line := range strings.Split(text, "\n") {
 				if len(line) == 0 {
 					continue
 				}
+				lines = append(lines, splitLine(line, max)...)
+			}
+			if n := cfg.MaxLines; n > 0 && len(lines) > n {
+				lines = append(lines[:n], fmt.Sprintf("(%d more lines truncated)", len(lines)-n))
+			}
+
+			for _, line := range lines {
 				server.cs.send(chanRequest{
 					Type: CR_PRIVMSG,
-					Name: channel.Name,
+					Name: chanName,
 					// TODO: We can do better.
-					User: &User{Prefix: &irc.Prefix{
-						Name: name,
-						User: "auto",
-						Host: "redis",
-					}},
-					Params: []string{line}})
+					User: &User{
+						Nick:   name,
+						Prefix: prefix,
+					},
+					Params: []string{line},
+					Tags:   messageTags(tags, ts)})
 			}
 
-		case m := <-ircCh:
-			if m == nil {
+		case out, ok := <-ircCh:
+			if !ok {
 				return
 			}
-			// Avoid loops, even if they should be unlikely given we force a
-			// different output channel.
-			if m.Prefix.Host != "redis" {
-				pubConn.Do(context.TODO(), radix.Cmd(nil, "PUBLISH", pubsub+":out", m.Prefix.Name+" "+m.Params[1]))
-			}
+			pubConn.Do(context.TODO(), radix.Cmd(nil, "PUBLISH", pubsub+":out", out))
+		}
+	}
+}
+
+// pubsubOut is a message published as JSON, for +A.
+type pubsubOut struct {
+	Nick    string `json:"nick"`
+	Account string `json:"account,omitempty"`
+	Text    string `json:"text"`
+	Action  bool   `json:"action,omitempty"`
+}
+
+// pubsubLine formats a message to publish to :out, "nick text" or for actions
+// "* nick text", or JSON including the user's account if asJSON is set.
+func pubsubLine(user *User, text string, action, asJSON bool) string {
+	if asJSON {
+		b, _ := json.Marshal(pubsubOut{Nick: user.Nick, Account: user.Account, Text: text, Action: action})
+		return string(b)
+	}
+	if action {
+		// "*" can't be a nick, so marks an action unambiguously.
+		return "* " + user.Nick + " " + text
+	}
+	return user.Nick + " " + text
+}
+
+// tagValue formats a value from JSON for use in a tag, strings as is, anything
+// else as JSON.
+func tagValue(v interface{}) string {
+	s, ok := v.(string)
+	if !ok {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return ""
+		}
+		s = string(b)
+	}
+	return truncateUTF8(s, maxTagValue)
+}
+
+// splitLine splits text into lines of at most max bytes, at the last space
+// that fits, otherwise without cutting a UTF-8 sequence in half.
+func splitLine(text string, max int) []string {
+	var lines []string
+	for len(text) > max {
+		if i := strings.LastIndexByte(text[:max+1], ' '); i > 0 {
+			lines = append(lines, text[:i])
+			text = text[i+1:]
+			continue
+		}
+		line := truncateUTF8(text, max)
+		if len(line) == 0 {
+			// Not UTF-8, just cut it.
+			line = text[:max]
 		}
+		lines = append(lines, line)
+		text = text[len(line):]
+	}
+	if len(text) > 0 {
+		lines = append(lines, text)
 	}
+	return lines
+}
+
+func redisSetTopic(name, chanName string, server *Server, topic string) {
+	// Topics are a single line.
+	topic = strings.Split(topic, "\n")[0]
+	server.cs.send(chanRequest{
+		Type: CR_TOPIC,
+		Name: chanName,
+		User: &User{
+			Nick: name,
+			Prefix: &irc.Prefix{
+				Name: name,
+				User: "auto",
+				Host: "redis",
+			}},
+		Params: []string{topic}})
 }
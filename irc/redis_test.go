@@ -0,0 +1,54 @@
+package irc
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitLine(t *testing.T) {
+	tests := []struct {
+		text string
+		max  int
+		want []string
+	}{
+		{"", 10, nil},
+		{"hello world", 20, []string{"hello world"}},
+		{"hello world", 11, []string{"hello world"}},
+		{"hello world", 5, []string{"hello", "world"}},
+		{"hello world", 7, []string{"hello", "world"}},
+		{"a  b", 2, []string{"a ", "b"}},
+		{"aaaaaaaaaa", 4, []string{"aaaa", "aaaa", "aa"}},
+		{" abc", 2, []string{" a", "bc"}},
+		{"héllo", 2, []string{"h", "é", "ll", "o"}},
+		{"éé", 3, []string{"é", "é"}},
+		{"\xa9\xa9\xa9", 2, []string{"\xa9\xa9", "\xa9"}},
+	}
+	for _, tt := range tests {
+		if got := splitLine(tt.text, tt.max); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitLine(%q, %d) = %q, want %q", tt.text, tt.max, got, tt.want)
+		}
+	}
+}
+
+func TestPubsubLine(t *testing.T) {
+	alice := &User{Nick: "alice", Account: "alice"}
+	bob := &User{Nick: "bob"}
+	tests := []struct {
+		user           *User
+		text           string
+		action, asJSON bool
+		want           string
+	}{
+		{alice, "hello there", false, false, "alice hello there"},
+		{alice, "waves", true, false, "* alice waves"},
+		{bob, "hello", false, false, "bob hello"},
+		{alice, "hello", false, true, `{"nick":"alice","account":"alice","text":"hello"}`},
+		{bob, "waves", true, true, `{"nick":"bob","text":"waves","action":true}`},
+	}
+	for _, tt := range tests {
+		if got := pubsubLine(tt.user, tt.text, tt.action, tt.asJSON); got != tt.want {
+			t.Errorf("pubsubLine(%q, %q, %v, %v) = %q, want %q",
+				tt.user.Nick, tt.text, tt.action, tt.asJSON, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package irc
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"log"
+	"strings"
+
+	"github.com/dgl/redisircd/ircbuf"
+
+	"github.com/mediocregopher/radix/v4"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/sorcix/irc.v2"
+)
+
+const (
+	// AUTHENTICATE payloads are sent in chunks of this size
+	saslChunkSize = 400
+	// Limit on the total size of a payload
+	saslMaxSize = 4096
+)
+
+func (c *Client) authenticate(m *ircbuf.Message) error {
+	if len(m.Params) < 1 {
+		c.reply(irc.ERR_NEEDMOREPARAMS, "AUTHENTICATE", "Not enough parameters")
+		return nil
+	}
+	if !c.caps.has("sasl") {
+		c.reply(irc.ERR_UNKNOWNCOMMAND, "AUTHENTICATE", "You must request the sasl capability first")
+		return nil
+	}
+	if len(c.account) > 0 {
+		c.reply("907" /* ERR_SASLALREADY */, "You have already authenticated using SASL")
+		return nil
+	}
+
+	p := m.Params[0]
+	if p == "*" {
+		c.saslMech, c.saslBuf = "", ""
+		c.reply("906" /* ERR_SASLABORTED */, "SASL authentication aborted")
+		return nil
+	}
+
+	if len(c.saslMech) == 0 {
+		if p != "PLAIN" {
+			c.reply("908" /* RPL_SASLMECHS */, "PLAIN", "are available SASL mechanisms")
+			c.reply("904" /* ERR_SASLFAIL */, "SASL authentication failed")
+			return nil
+		}
+		c.saslMech = p
+		c.send(&irc.Message{Command: "AUTHENTICATE", Params: []string{"+"}})
+		return nil
+	}
+
+	if p != "+" {
+		c.saslBuf += p
+	}
+	if len(c.saslBuf) > saslMaxSize {
+		c.saslMech, c.saslBuf = "", ""
+		c.reply("905" /* ERR_SASLTOOLONG */, "SASL message too long")
+		return nil
+	}
+	if len(p) == saslChunkSize {
+		// More to come.
+		return nil
+	}
+
+	payload, err := base64.StdEncoding.DecodeString(c.saslBuf)
+	c.saslMech, c.saslBuf = "", ""
+	if err != nil {
+		c.reply("904" /* ERR_SASLFAIL */, "SASL authentication failed")
+		return nil
+	}
+
+	// authzid NUL authcid NUL passwd
+	parts := bytes.Split(payload, []byte{0})
+	if len(parts) != 3 || (len(parts[0]) > 0 && !bytes.Equal(parts[0], parts[1])) {
+		c.reply("904" /* ERR_SASLFAIL */, "SASL authentication failed")
+		return nil
+	}
+	account := string(parts[1])
+
+	if !c.Server.checkPassword(account, parts[2]) {
+		c.reply("904" /* ERR_SASLFAIL */, "SASL authentication failed")
+		return nil
+	}
+
+	c.account = account
+	mask := c.nick
+	if len(mask) == 0 {
+		mask = "*"
+	}
+	mask += "!" + strings.TrimPrefix(c.username, "~") + "@" + c.host()
+	if c.connected {
+		// Already connected, so keeps the ~.
+		mask = c.User.Prefix.String()
+	}
+	c.reply("900" /* RPL_LOGGEDIN */, mask, account, "You are now logged in as "+account)
+	c.reply("903" /* RPL_SASLSUCCESS */, "SASL authentication successful")
+	if c.connected {
+		c.Server.ns.send(nickRequest{Type: NR_ACCOUNT, User: c.User, Params: []string{account}})
+	}
+	return nil
+}
+
+// checkPassword checks the password against the bcrypt hash stored in the
+// AccountsKey hash in Redis.
+func (s *Server) checkPassword(account string, password []byte) bool {
+	if len(s.AccountsKey) == 0 || len(account) == 0 {
+		return false
+	}
+
+	conn, err := radix.Dial(context.TODO(), "tcp", s.RedisHost)
+	if err != nil {
+		log.Printf("Failed dial: %v", err)
+		return false
+	}
+	defer conn.Close()
+
+	var hash string
+	err = conn.Do(context.TODO(), radix.Cmd(&hash, "HGET", s.AccountsKey, account))
+	if err != nil {
+		log.Printf("Failed to get account %q: %v", account, err)
+		return false
+	}
+	if len(hash) == 0 {
+		return false
+	}
+
+	return bcrypt.CompareHashAndPassword([]byte(hash), password) == nil
+}
@@ -0,0 +1,126 @@
+package irc
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// fakeRedis answers HGET from hash, enough for checkPassword.
+func fakeRedis(t *testing.T, hash map[string]string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					cmd, err := readRESP(r)
+					if err != nil {
+						return
+					}
+					if len(cmd) != 3 || strings.ToUpper(cmd[0]) != "HGET" {
+						fmt.Fprintf(conn, "-ERR unknown command\r\n")
+					} else if v, ok := hash[cmd[2]]; ok {
+						fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(v), v)
+					} else {
+						fmt.Fprintf(conn, "$-1\r\n")
+					}
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// readRESP reads a command, an array of bulk strings.
+func readRESP(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil {
+		return nil, err
+	}
+	var cmd []string
+	for i := 0; i < n; i++ {
+		if _, err := r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		arg, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		cmd = append(cmd, strings.TrimRight(arg, "\r\n"))
+	}
+	return cmd, nil
+}
+
+func TestSASLPlain(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer("test.server", fakeRedis(t, map[string]string{"alice": string(hash)}), false)
+	s.AccountsKey = "accounts"
+	addr := startTestServer(t, s)
+	plain := func(authcid, passwd string) string {
+		return base64.StdEncoding.EncodeToString([]byte("\x00" + authcid + "\x00" + passwd))
+	}
+
+	tc := dialTest(t, addr)
+	tc.send("CAP LS 302")
+	tc.expect("CAP")
+	tc.send("AUTHENTICATE PLAIN")
+	if m := tc.read(); m.Command != "421" {
+		t.Errorf("AUTHENTICATE without sasl = %v, want ERR_UNKNOWNCOMMAND", m)
+	}
+	tc.send("CAP REQ sasl")
+	tc.expect("CAP")
+	tc.send("NICK alice")
+	tc.send("USER alice 0 * :Alice")
+
+	tc.send("AUTHENTICATE PLAIN")
+	if m := tc.read(); m.Command != "AUTHENTICATE" || m.Params[0] != "+" {
+		t.Errorf("AUTHENTICATE PLAIN = %v, want AUTHENTICATE +", m)
+	}
+	tc.send("AUTHENTICATE " + plain("alice", "wrong"))
+	if m := tc.read(); m.Command != "904" {
+		t.Errorf("wrong password = %v, want ERR_SASLFAIL", m)
+	}
+
+	tc.send("AUTHENTICATE PLAIN")
+	tc.expect("AUTHENTICATE")
+	tc.send("AUTHENTICATE " + plain("alice", "secret"))
+	if m := tc.read(); m.Command != "900" || m.Params[1] != "alice!alice@127.0.0.1" || m.Params[2] != "alice" {
+		t.Errorf("right password = %v, want RPL_LOGGEDIN", m)
+	}
+	tc.expect("903")
+	tc.send("CAP END")
+	tc.expect("422")
+
+	// Authenticated, so no ~ on the username.
+	tc.send("WHOIS alice")
+	if m := tc.expect("311"); m.Params[2] != "alice" {
+		t.Errorf("RPL_WHOISUSER = %v, want username alice", m)
+	}
+	if m := tc.expect("330"); m.Params[2] != "alice" {
+		t.Errorf("RPL_WHOISACCOUNT = %v, want account alice", m)
+	}
+}
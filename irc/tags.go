@@ -0,0 +1,88 @@
+package irc
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/dgl/redisircd/ircbuf"
+)
+
+const (
+	// Format of the server-time tag
+	serverTimeFormat = "2006-01-02T15:04:05.000Z"
+)
+
+// newMsgID returns a unique ID for the msgid tag.
+func newMsgID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// messageTags adds the tags for a PRIVMSG or NOTICE sent at time t, to any
+// existing tags (which take precedence).
+func messageTags(tags ircbuf.Tags, t time.Time) ircbuf.Tags {
+	mt := ircbuf.Tags{
+		"time":  t.UTC().Format(serverTimeFormat),
+		"msgid": newMsgID(),
+	}
+	for k, v := range tags {
+		mt[k] = v
+	}
+	return mt
+}
+
+// parseTimestamp understands timestamps from JSON payloads, either RFC3339
+// strings or numeric Unix times in seconds or milliseconds.
+func parseTimestamp(v interface{}) (time.Time, error) {
+	switch t := v.(type) {
+	case string:
+		if f, err := strconv.ParseFloat(t, 64); err == nil {
+			return parseTimestamp(f)
+		}
+		return time.Parse(time.RFC3339Nano, t)
+	case float64:
+		if t > 1e12 {
+			// Must be milliseconds, seconds this large are a long way off.
+			return time.Unix(0, int64(t*float64(time.Millisecond))), nil
+		}
+		return time.Unix(0, int64(t*float64(time.Second))), nil
+	}
+	return time.Time{}, fmt.Errorf("unknown timestamp type %T", v)
+}
+
+// filterTags removes any tags the user's client hasn't enabled support for.
+// server-time is added if missing, so all messages have it.
+func (u *User) filterTags(tags ircbuf.Tags) ircbuf.Tags {
+	serverTime := u.hasCap("server-time")
+	messageTags := u.hasCap("message-tags")
+	batch := u.hasCap("batch")
+	if !serverTime && !messageTags && !batch {
+		return nil
+	}
+
+	t := ircbuf.Tags{}
+	for k, v := range tags {
+		switch {
+		case k == "label":
+			// Internal, marks labeled responses, see label.go
+		case k == "time":
+			if serverTime {
+				t[k] = v
+			}
+		case k == "batch":
+			if batch {
+				t[k] = v
+			}
+		case messageTags:
+			t[k] = v
+		}
+	}
+	if _, ok := t["time"]; serverTime && !ok {
+		t["time"] = time.Now().UTC().Format(serverTimeFormat)
+	}
+	return t
+}
@@ -0,0 +1,43 @@
+package irc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTimestamp(t *testing.T) {
+	tests := []struct {
+		v       interface{}
+		want    time.Time
+		wantErr bool
+	}{
+		{v: "2023-11-14T22:13:20Z", want: time.Unix(1700000000, 0)},
+		{v: "2023-11-14T23:13:20.5+01:00", want: time.Unix(1700000000, 5e8)},
+		{v: "1700000000", want: time.Unix(1700000000, 0)},
+		{v: float64(1700000000), want: time.Unix(1700000000, 0)},
+		{v: 1700000000.25, want: time.Unix(1700000000, 25e7)},
+		{v: float64(1700000000123), want: time.Unix(1700000000, 123e6)},
+		{v: "1700000000123", want: time.Unix(1700000000, 123e6)},
+		{v: "yesterday", wantErr: true},
+		{v: "", wantErr: true},
+		{v: true, wantErr: true},
+		{v: nil, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseTimestamp(tt.v)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseTimestamp(%#v) = %v, want error", tt.v, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseTimestamp(%#v) error: %v", tt.v, err)
+			continue
+		}
+		// Floats aren't exact to the nanosecond.
+		if d := got.Sub(tt.want); d < -time.Microsecond || d > time.Microsecond {
+			t.Errorf("parseTimestamp(%#v) = %v, want %v", tt.v, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package irc
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// Longest +F template output, anything more is an error
+const maxTemplateOutput = 8192
+
+// ircColours are the names of the standard mIRC colours, for colour.
+var ircColours = map[string]int{
+	"white": 0, "black": 1, "blue": 2, "green": 3, "red": 4, "brown": 5,
+	"purple": 6, "orange": 7, "yellow": 8, "lightgreen": 9, "cyan": 10,
+	"lightcyan": 11, "lightblue": 12, "pink": 13, "grey": 14, "lightgrey": 15,
+}
+
+// templateFuncs are the helpers available to templates for +F.
+var templateFuncs = template.FuncMap{
+	"bold": func(v interface{}) string {
+		return "\x02" + templateString(v) + "\x02"
+	},
+	"colour": templateColour,
+	"color":  templateColour,
+	"truncate": func(n int, v interface{}) string {
+		r := []rune(templateString(v))
+		if n < 0 || len(r) <= n {
+			return string(r)
+		}
+		return string(r[:n]) + "…"
+	},
+	"time": func(layout string, v interface{}) (string, error) {
+		if n, ok := v.(json.Number); ok {
+			v = n.String()
+		}
+		t, err := parseTimestamp(v)
+		if err != nil {
+			return "", err
+		}
+		return t.Format(layout), nil
+	},
+	"default": func(def string, v interface{}) string {
+		if s := templateString(v); len(s) > 0 {
+			return s
+		}
+		return def
+	},
+}
+
+// templateString formats a value from JSON as text for the helpers, nothing
+// for missing values. A bare {{.missing}} still prints "<no value>", as
+// text/template ignores missingkey for interface maps, use default or with.
+func templateString(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+// templateColour colours text, the colour is a name from ircColours or a
+// number.
+func templateColour(colour string, v interface{}) (string, error) {
+	n, ok := ircColours[strings.ToLower(colour)]
+	if !ok {
+		var err error
+		if n, err = strconv.Atoi(colour); err != nil || n < 0 || n > 98 {
+			return "", fmt.Errorf("unknown colour %q", colour)
+		}
+	}
+	return fmt.Sprintf("\x03%02d%s\x03", n, templateString(v)), nil
+}
+
+// parseTemplates parses the named templates from a file, defined with
+// {{define "name"}}.
+func parseTemplates(file string) (*template.Template, error) {
+	return template.New("").Funcs(templateFuncs).ParseFiles(file)
+}
+
+// template returns the template given to +F, either inline if it contains
+// "{{", otherwise the name of one from TemplateFile.
+func (s *Server) template(p string) (*template.Template, error) {
+	if strings.Contains(p, "{{") {
+		return template.New("inline").Funcs(templateFuncs).Parse(p)
+	}
+
+	s.templatesMu.RLock()
+	defer s.templatesMu.RUnlock()
+	var t *template.Template
+	if s.templates != nil {
+		t = s.templates.Lookup(p)
+	}
+	if t == nil {
+		return nil, fmt.Errorf("no template named %q", p)
+	}
+	return t, nil
+}
+
+// renderTemplate executes a +F template against a JSON payload.
+func renderTemplate(t *template.Template, payload []byte) (string, error) {
+	// Numbers are kept as written, rather than floats that would print large
+	// ones like timestamps with exponents.
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+	var j interface{}
+	if err := dec.Decode(&j); err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	if err := t.Execute(&limitWriter{w: &b, n: maxTemplateOutput}, j); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+var errTemplateTooLong = fmt.Errorf("template output over %d bytes", maxTemplateOutput)
+
+// limitWriter stops a template once it has written more than n bytes, so a
+// range over a large payload can't build an unbounded message.
+type limitWriter struct {
+	w io.Writer
+	n int
+}
+
+func (l *limitWriter) Write(p []byte) (int, error) {
+	if len(p) > l.n {
+		return 0, errTemplateTooLong
+	}
+	l.n -= len(p)
+	return l.w.Write(p)
+}
@@ -0,0 +1,22 @@
+package irc
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"text/template"
+)
+
+func TestRenderTemplateLimit(t *testing.T) {
+	tmpl := template.Must(template.New("").Funcs(templateFuncs).Parse(
+		`{{range .}}{{.}}{{end}}`))
+	small := `["` + strings.Repeat("a", 100) + `"]`
+	if got, err := renderTemplate(tmpl, []byte(small)); err != nil || len(got) != 100 {
+		t.Errorf("renderTemplate(small) = %d bytes, %v", len(got), err)
+	}
+	item := `"` + strings.Repeat("a", 1000) + `"`
+	large := "[" + strings.TrimSuffix(strings.Repeat(item+",", 10), ",") + "]"
+	if _, err := renderTemplate(tmpl, []byte(large)); !errors.Is(err, errTemplateTooLong) {
+		t.Errorf("renderTemplate(large) error = %v, want %v", err, errTemplateTooLong)
+	}
+}
@@ -2,6 +2,9 @@ package irc
 
 import (
 	"log"
+	"sync/atomic"
+
+	"github.com/dgl/redisircd/ircbuf"
 
 	"gopkg.in/sorcix/irc.v2"
 )
@@ -10,12 +13,71 @@ type User struct {
 	// Must only be written by nickServer
 	Nick   string
 	Prefix *irc.Prefix
+	// Account name if authenticated with SASL
+	Account string
+	// Away message, empty if not away
+	Away string
+	// Atomic as the channel server reads them too, see modes and setMode
+	Modes userModes
 
 	// Must only be written by chanServer
 	Channels map[*channel]struct{}
 
 	client   *Client
-	out, err chan<- *irc.Message
+	out, err chan<- *ircbuf.Message
+}
+
+// userModes are the modes a user sets on themselves (apart from UM_OPER)
+type userModes int32
+
+const (
+	UM_INVISIBLE userModes = 1 << iota
+	UM_WALLOPS
+	// A bot, shown in WHO and WHOIS
+	UM_BOT
+	// Doesn't receive channel messages, e.g. a bot that only publishes
+	UM_DEAF
+	// Server operator, after OPER
+	UM_OPER
+)
+
+// userModeChars are the mode characters for userModes
+var userModeChars = map[rune]userModes{
+	'i': UM_INVISIBLE,
+	'w': UM_WALLOPS,
+	'B': UM_BOT,
+	'D': UM_DEAF,
+	'o': UM_OPER,
+}
+
+func (u *User) modes() userModes {
+	return userModes(atomic.LoadInt32((*int32)(&u.Modes)))
+}
+
+func (u *User) hasMode(mode userModes) bool {
+	return u.modes()&mode == mode
+}
+
+// setMode sets or clears a mode, only the nick server can call it.
+func (u *User) setMode(mode userModes, on bool) {
+	m := u.modes()
+	if on {
+		m |= mode
+	} else {
+		m &^= mode
+	}
+	atomic.StoreInt32((*int32)(&u.Modes), int32(m))
+}
+
+// umodes returns the user's modes, as shown in RPL_UMODEIS.
+func (u *User) umodes() string {
+	modes := "+"
+	for _, c := range "BDiow" {
+		if u.hasMode(userModeChars[c]) {
+			modes += string(c)
+		}
+	}
+	return modes
 }
 
 func NewUser(c *Client) *User {
@@ -26,6 +88,13 @@ func NewUser(c *Client) *User {
 }
 
 func (u *User) Send(m *irc.Message) {
+	u.SendTags(nil, m)
+}
+
+// SendTags sends a message with IRCv3 tags, only the tags the user's client
+// supports are actually sent.
+func (u *User) SendTags(tags ircbuf.Tags, msg *irc.Message) {
+	m := &ircbuf.Message{Tags: tags, Message: msg}
 	select {
 	case u.out <- m:
 	default:
@@ -37,17 +106,74 @@ func (u *User) Send(m *irc.Message) {
 	}
 }
 
+// virtual is true for users that only exist as the source of messages from
+// Redis, they have no client connection.
+func (u *User) virtual() bool {
+	return u.client == nil
+}
+
+// hasCap is true if the user's client has enabled the given capability.
+func (u *User) hasCap(name string) bool {
+	return !u.virtual() && u.client.caps.has(name)
+}
+
+// realname is the realname given by the client, or a description of the
+// Redis source for virtual users.
+func (u *User) realname() string {
+	if u.virtual() {
+		return "Redis pubsub"
+	}
+	return u.client.Realname
+}
+
+// whoReply sends a RPL_WHOREPLY line describing who to the user.
+func (r *responder) whoReply(user, who *User, channel, flags string) {
+	status := "H"
+	if len(who.Away) > 0 {
+		status = "G"
+	}
+	if who.hasMode(UM_OPER) {
+		status += "*"
+	}
+	status += flags
+	if who.hasMode(UM_BOT) {
+		status += "B"
+	}
+	r.reply(user, irc.RPL_WHOREPLY, channel, who.Prefix.User, who.Prefix.Host,
+		r.server.Name, who.Nick, status, "0 "+who.realname())
+}
+
 func (u *User) output() {
-	out := make(chan *irc.Message, 512)
+	out := make(chan *ircbuf.Message, 512)
 	u.out = out
-	err := make(chan *irc.Message, 1)
+	err := make(chan *ircbuf.Message, 1)
 	u.err = err
 
 	go func() {
+		// Responses to labeled commands in progress, see label.go
+		labelled := map[string][]*ircbuf.Message{}
+
 		for {
 			select {
 			case m := <-out:
-				u.client.Encode(m)
+				label, hasLabel := m.Tags["label"]
+				if len(m.Command) == 0 {
+					if m.Params[0] == "+" {
+						labelled[label] = nil
+					} else if msgs, ok := labelled[label]; ok {
+						u.sendLabelled(label, msgs)
+						delete(labelled, label)
+					}
+					continue
+				}
+				if msgs, ok := labelled[label]; ok && hasLabel {
+					labelled[label] = append(msgs, m)
+					continue
+				}
+				u.client.EncodeMessage(&ircbuf.Message{
+					Tags:    u.filterTags(m.Tags),
+					Message: m.Message,
+				})
 			case <-err:
 				// not keeping up, bye
 				// TODO: propagate an error
@@ -0,0 +1,40 @@
+package irc
+
+import "testing"
+
+func TestUserModes(t *testing.T) {
+	_, addr := newTestServer(t)
+	alice := register(t, addr, "alice")
+	bob := register(t, addr, "bob")
+	carol := register(t, addr, "carol")
+	joinTest(t, alice, bob)
+
+	bob.send("MODE bob +iD")
+	if m := bob.expect("MODE"); m.Params[1] != "+i+D" {
+		t.Errorf("MODE bob +iD = %v", m)
+	}
+
+	// Invisible, so hidden from those not sharing a channel.
+	carol.send("NAMES #x")
+	if m := carol.expect("353"); m.Params[3] != "@alice" {
+		t.Errorf("NAMES from outside = %v, want only alice", m)
+	}
+	alice.send("NAMES #x")
+	if m := alice.expect("353"); m.Params[3] != "@alice bob" && m.Params[3] != "bob @alice" {
+		t.Errorf("NAMES from inside = %v, want alice and bob", m)
+	}
+
+	// Deaf, so doesn't get channel messages, the topic change after it goes
+	// the same way.
+	alice.send("PRIVMSG #x :to the channel")
+	alice.send("TOPIC #x :after")
+	for {
+		m := bob.read()
+		if m.Command == "TOPIC" {
+			break
+		}
+		if m.Command == "PRIVMSG" {
+			t.Errorf("deaf user got %v", m)
+		}
+	}
+}
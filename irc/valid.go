@@ -1,5 +1,7 @@
 package irc
 
+import "strings"
+
 // https://datatracker.ietf.org/doc/html/rfc2812#section-2.3.1
 // with slightly extended nickname length
 func validNick(n string) bool {
@@ -46,3 +48,79 @@ func validChan(c string) bool {
 
 	return true
 }
+
+// Channel keys, as given to +k and JOIN.
+func validKey(k string) bool {
+	if len(k) < 1 || len(k) > 23 {
+		return false
+	}
+
+	for _, x := range k {
+		if x <= ' ' || x == ':' || x == ',' || x == '\x7F' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Names of tags given to +X, the rest of the tag name is fixed.
+func validTagName(n string) bool {
+	if len(n) < 1 || len(n) > 32 {
+		return false
+	}
+
+	for _, x := range n {
+		if (x >= 'a' && x <= 'z') || (x >= 'A' && x <= 'Z') || (x >= '0' && x <= '9') || x == '-' {
+			continue
+		}
+		return false
+	}
+
+	return true
+}
+
+// matchMask matches s against an IRC style glob mask, where '*' matches any
+// number of characters and '?' matches exactly one. Matching is case
+// insensitive, as per CASEMAPPING=ascii.
+func matchMask(mask, s string) bool {
+	mask, s = strings.ToLower(mask), strings.ToLower(s)
+
+	mi, si := 0, 0
+	star, mark := -1, 0
+	for si < len(s) {
+		if mi < len(mask) && (mask[mi] == '?' || mask[mi] == s[si]) {
+			mi++
+			si++
+		} else if mi < len(mask) && mask[mi] == '*' {
+			star = mi
+			mark = si
+			mi++
+		} else if star >= 0 {
+			mi = star + 1
+			mark++
+			si = mark
+		} else {
+			return false
+		}
+	}
+	for mi < len(mask) && mask[mi] == '*' {
+		mi++
+	}
+	return mi == len(mask)
+}
+
+// normalizeMask expands a partial mask to a full nick!user@host mask
+func normalizeMask(mask string) string {
+	hasUser := strings.Contains(mask, "!")
+	hasHost := strings.Contains(mask, "@")
+	switch {
+	case hasUser && hasHost:
+		return mask
+	case hasUser:
+		return mask + "@*"
+	case hasHost:
+		return "*!" + mask
+	}
+	return mask + "!*@*"
+}
@@ -0,0 +1,32 @@
+package irc
+
+import "testing"
+
+func TestMatchMask(t *testing.T) {
+	tests := []struct {
+		mask, s string
+		want    bool
+	}{
+		{"*!*@*", "nick!user@host", true},
+		{"nick!*@*", "nick!user@host", true},
+		{"NICK!*@*", "nick!user@host", true},
+		{"nick!*@*", "nick2!user@host", false},
+		{"*!*@127.0.0.1", "nick!~user@127.0.0.1", true},
+		{"*!*@127.0.0.?", "nick!~user@127.0.0.12", false},
+		{"n?ck!*@*", "neck!user@host", true},
+		{"n?ck!*@*", "nck!user@host", false},
+		{"*bar*", "foobarbaz", true},
+		{"*bar", "foobarbaz", false},
+		{"a*b*c", "aXbYbZc", true},
+		{"a*b*c", "aXbYbZ", false},
+		{"**", "", true},
+		{"", "", true},
+		{"", "x", false},
+		{"?", "", false},
+	}
+	for _, tt := range tests {
+		if got := matchMask(tt.mask, tt.s); got != tt.want {
+			t.Errorf("matchMask(%q, %q) = %v, want %v", tt.mask, tt.s, got, tt.want)
+		}
+	}
+}
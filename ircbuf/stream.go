@@ -10,8 +10,11 @@ package ircbuf
 import (
 	"bufio"
 	"crypto/tls"
+	"errors"
 	"io"
 	"net"
+	"strings"
+	"unicode/utf8"
 
 	"gopkg.in/sorcix/irc.v2"
 )
@@ -23,6 +26,11 @@ const delim byte = '\n'
 
 var endline = []byte("\r\n")
 
+// ErrInvalidUTF8 is returned by Decode, along with the message (which may be
+// nil if the line didn't parse), if the line isn't valid UTF-8 and UTF8Only is
+// set.
+var ErrInvalidUTF8 = errors.New("invalid UTF-8")
+
 // A Conn represents an IRC network protocol connection.
 // It consists of an Encoder and Decoder to manage I/O.
 type Conn struct {
@@ -78,6 +86,10 @@ func (c *Conn) Close() error {
 type Decoder struct {
 	Reader *bufio.Reader
 	line   string
+
+	// Reject lines that aren't valid UTF-8, otherwise invalid bytes are
+	// replaced with U+FFFD
+	UTF8Only bool
 }
 
 // NewDecoder returns a new Decoder that reads from r.
@@ -90,7 +102,7 @@ func NewDecoder(r io.Reader) *Decoder {
 // Decode attempts to read a single Message from the stream.
 //
 // Returns a non-nil error if the read failed.
-func (dec *Decoder) Decode() (m *irc.Message, err error) {
+func (dec *Decoder) Decode() (m *Message, err error) {
 
 	dec.line, err = dec.Reader.ReadString(delim)
 
@@ -98,7 +110,15 @@ func (dec *Decoder) Decode() (m *irc.Message, err error) {
 		return nil, err
 	}
 
-	return irc.ParseMessage(dec.line), nil
+	line := dec.line
+	if !utf8.ValidString(line) {
+		if dec.UTF8Only {
+			return ParseMessage(line), ErrInvalidUTF8
+		}
+		line = strings.ToValidUTF8(line, "\uFFFD")
+	}
+
+	return ParseMessage(line), nil
 }
 
 // LastLine returns the last line read by Decoder, in raw form.
@@ -128,11 +148,29 @@ func (enc *Encoder) Encode(m *irc.Message) (err error) {
 	return
 }
 
+// EncodeMessage writes the IRC encoding of m, including any tags, to the
+// stream.
+func (enc *Encoder) EncodeMessage(m *Message) (err error) {
+	tags := m.Tags.Bytes()
+	if tags == nil {
+		return enc.Encode(m.Message)
+	}
+
+	_, err = enc.write(append(tags, ' '), m.Bytes())
+
+	return
+}
+
 // Write writes len(p) bytes from p followed by CR+LF.
 func (enc *Encoder) Write(p []byte) (n int, err error) {
+	return enc.write(p)
+}
+
+// write writes each of ps followed by CR+LF, as one write if possible.
+func (enc *Encoder) write(ps ...[]byte) (n int, err error) {
 
 	if tcpconn, ok := enc.Writer.(*net.TCPConn); ok {
-		buffers := net.Buffers{p, endline}
+		buffers := append(net.Buffers(ps), endline)
 
 		var nv int64
 		nv, err = buffers.WriteTo(tcpconn)
@@ -141,9 +179,13 @@ func (enc *Encoder) Write(p []byte) (n int, err error) {
 			n = int(nv)
 		}
 	} else {
-		n, err = enc.Writer.Write(p)
-		if err != nil {
-			return
+		for _, p := range ps {
+			var nw int
+			nw, err = enc.Writer.Write(p)
+			n += nw
+			if err != nil {
+				return
+			}
 		}
 
 		_, err = enc.Writer.Write(endline)
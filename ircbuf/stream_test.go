@@ -0,0 +1,40 @@
+package ircbuf
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDecodeUTF8(t *testing.T) {
+	tests := []struct {
+		line     string
+		utf8Only bool
+		want     string
+		wantErr  error
+	}{
+		{"PRIVMSG #a :héllo\r\n", true, "PRIVMSG #a héllo", nil},
+		{"PRIVMSG #a :h\xe9llo\r\n", false, "PRIVMSG #a h\uFFFDllo", nil},
+		{"PRIVMSG #a :h\xe9llo\r\n", true, "PRIVMSG #a h\xe9llo", ErrInvalidUTF8},
+		// Lines that don't parse give a nil message.
+		{"\xff\r\n", true, "", ErrInvalidUTF8},
+		{":\xff\r\n", true, "", ErrInvalidUTF8},
+		{"@a=\xff\r\n", true, "", ErrInvalidUTF8},
+		{"\xff\r\n", false, "\uFFFD", nil},
+		{":\xff\r\n", false, "", nil},
+	}
+	for _, tt := range tests {
+		dec := NewDecoder(strings.NewReader(tt.line))
+		dec.UTF8Only = tt.utf8Only
+		m, err := dec.Decode()
+		if err != tt.wantErr {
+			t.Errorf("Decode(%q) error = %v, want %v", tt.line, err, tt.wantErr)
+		}
+		got := ""
+		if m != nil {
+			got = m.String()
+		}
+		if got != tt.want {
+			t.Errorf("Decode(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
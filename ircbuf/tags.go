@@ -0,0 +1,138 @@
+package ircbuf
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+
+	"gopkg.in/sorcix/irc.v2"
+)
+
+// Tags are IRCv3 message tags, a tag with no value has an empty string.
+type Tags map[string]string
+
+// Message is an IRC message with IRCv3 tags.
+type Message struct {
+	Tags Tags
+	*irc.Message
+}
+
+var tagEscaper = strings.NewReplacer(
+	"\\", "\\\\",
+	";", "\\:",
+	" ", "\\s",
+	"\r", "\\r",
+	"\n", "\\n",
+)
+
+// ParseMessage parses a line that may start with IRCv3 tags.
+// Returns nil if the Message is invalid.
+func ParseMessage(raw string) *Message {
+	var tags Tags
+	if len(raw) > 0 && raw[0] == '@' {
+		i := strings.IndexByte(raw, ' ')
+		if i < 0 {
+			return nil
+		}
+		tags = ParseTags(raw[1:i])
+		raw = raw[i+1:]
+	}
+
+	m := irc.ParseMessage(raw)
+	if m == nil {
+		return nil
+	}
+	return &Message{Tags: tags, Message: m}
+}
+
+// ParseTags parses tags in wire format, without the leading '@'.
+func ParseTags(raw string) Tags {
+	tags := Tags{}
+	for _, tag := range strings.Split(raw, ";") {
+		if len(tag) == 0 {
+			continue
+		}
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) == 1 {
+			tags[kv[0]] = ""
+			continue
+		}
+		tags[kv[0]] = unescapeTag(kv[1])
+	}
+	return tags
+}
+
+func unescapeTag(v string) string {
+	if !strings.Contains(v, "\\") {
+		return v
+	}
+	// A trailing lone backslash is dropped, as is the backslash before any
+	// other character.
+	var sb strings.Builder
+	for i := 0; i < len(v); i++ {
+		if v[i] != '\\' {
+			sb.WriteByte(v[i])
+			continue
+		}
+		i++
+		if i >= len(v) {
+			break
+		}
+		switch v[i] {
+		case ':':
+			sb.WriteByte(';')
+		case 's':
+			sb.WriteByte(' ')
+		case 'r':
+			sb.WriteByte('\r')
+		case 'n':
+			sb.WriteByte('\n')
+		default:
+			sb.WriteByte(v[i])
+		}
+	}
+	return sb.String()
+}
+
+// ClientOnly returns the client-only tags (those starting with '+').
+func (t Tags) ClientOnly() Tags {
+	var c Tags
+	for k, v := range t {
+		if len(k) > 1 && k[0] == '+' {
+			if c == nil {
+				c = Tags{}
+			}
+			c[k] = v
+		}
+	}
+	return c
+}
+
+// Bytes returns the tags in wire format, including the leading '@', or nil if
+// there are no tags.
+func (t Tags) Bytes() []byte {
+	if len(t) == 0 {
+		return nil
+	}
+
+	keys := make([]string, 0, len(t))
+	for k := range t {
+		keys = append(keys, k)
+	}
+	// Not required, but makes the output stable.
+	sort.Strings(keys)
+
+	buffer := new(bytes.Buffer)
+	buffer.WriteByte('@')
+	for i, k := range keys {
+		if i > 0 {
+			buffer.WriteByte(';')
+		}
+		buffer.WriteString(k)
+		if v := t[k]; len(v) > 0 {
+			buffer.WriteByte('=')
+			buffer.WriteString(tagEscaper.Replace(v))
+		}
+	}
+	return buffer.Bytes()
+}
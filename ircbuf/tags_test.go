@@ -0,0 +1,74 @@
+package ircbuf
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseTags(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want Tags
+	}{
+		{"", Tags{}},
+		{"a=b", Tags{"a": "b"}},
+		{"a=b;c", Tags{"a": "b", "c": ""}},
+		{"a=;c=d", Tags{"a": "", "c": "d"}},
+		{"a=b;;c=d;", Tags{"a": "b", "c": "d"}},
+		{"+example.com/x=y=z", Tags{"+example.com/x": "y=z"}},
+		{"a=one\\stwo\\:three", Tags{"a": "one two;three"}},
+		{"a=b;a=c", Tags{"a": "c"}},
+	}
+	for _, tt := range tests {
+		if got := ParseTags(tt.raw); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseTags(%q) = %v, want %v", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestUnescapeTag(t *testing.T) {
+	tests := []struct {
+		v, want string
+	}{
+		{"plain", "plain"},
+		{"a\\sb", "a b"},
+		{"a\\:b", "a;b"},
+		{"a\\\\b", "a\\b"},
+		{"a\\r\\nb", "a\r\nb"},
+		{"\\b", "b"},
+		{"trailing\\", "trailing"},
+		{"\\\\s", "\\s"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := unescapeTag(tt.v); got != tt.want {
+			t.Errorf("unescapeTag(%q) = %q, want %q", tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestTagsBytes(t *testing.T) {
+	tests := []struct {
+		tags Tags
+		want string
+	}{
+		{nil, ""},
+		{Tags{}, ""},
+		{Tags{"a": "b"}, "@a=b"},
+		{Tags{"c": "", "a": "b"}, "@a=b;c"},
+		{Tags{"a": "one two;three\\\r\n"}, "@a=one\\stwo\\:three\\\\\\r\\n"},
+	}
+	for _, tt := range tests {
+		if got := string(tt.tags.Bytes()); got != tt.want {
+			t.Errorf("%v.Bytes() = %q, want %q", tt.tags, got, tt.want)
+		}
+	}
+}
+
+func TestTagsRoundTrip(t *testing.T) {
+	tags := Tags{"time": "2023-11-14T22:13:20.000Z", "+x": "a;b c\\d", "flag": ""}
+	got := ParseTags(string(tags.Bytes()[1:]))
+	if !reflect.DeepEqual(got, tags) {
+		t.Errorf("round trip = %v, want %v", got, tags)
+	}
+}